@@ -16,8 +16,10 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/flant/elasticsearch-extractor/modules/cleanup"
 	"github.com/flant/elasticsearch-extractor/modules/config"
@@ -38,11 +40,15 @@ func init() {
 	flag.StringVar(&configfile, "config", "main.yml", "Read configuration from this file")
 	flag.StringVar(&configfile, "f", "main.yml", "Read configuration from this file")
 	vers := flag.Bool("V", false, "Show version")
+	check := flag.Bool("check", false, "Validate configuration file and exit")
 	flag.Parse()
 	if *vers {
 		print("version: ", version.Version, "( ", vBuild, " )\n")
 		os.Exit(0)
 	}
+	if *check {
+		os.Exit(checkConfig(configfile))
+	}
 
 	hostname, _ = os.Hostname()
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -50,7 +56,11 @@ func init() {
 
 	log.Println("Bootstrap: build num.", vBuild)
 
-	cnf = config.Parse(configfile)
+	var err error
+	cnf, err = config.Parse(configfile)
+	if err != nil {
+		log.Fatalf("Bootstrap: invalid config file %s:\n%s\n", configfile, err)
+	}
 	log.Println("Bootstrap: successful parsing config file.")
 	if _, err := os.Stat("/tmp/data"); errors.Is(err, os.ErrNotExist) {
 		err := os.Mkdir("/tmp/data", os.ModePerm)
@@ -61,7 +71,24 @@ func init() {
 
 }
 
+// checkConfig prints every problem found in the config file and returns the exit code
+func checkConfig(f string) int {
+	c, err := config.Parse(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: configuration is invalid:\n", f)
+		for _, e := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "  -", e)
+		}
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", f)
+	for _, cl := range c.Clusters {
+		fmt.Printf("  cluster %s: %s %v\n", cl.Name, strings.Join(cl.Hosts, ", "), cl.Roles)
+	}
+	return 0
+}
+
 func main() {
 	go cleanup.Run()
-	router.Run(cnf)
+	router.Run(cnf, configfile)
 }
@@ -62,8 +62,14 @@ $(document).ready(function(){
         var str = "";
         for(var k in data) {
           name = data[k].Name;
-          ctype = data[k].Type;
-          $('#clusters').append(new Option(name, ctype,false,false));
+          if (data[k].Roles && data[k].Roles.indexOf("search") == -1) {
+            continue;
+          }
+          var label = name;
+          if (data[k].Version) {
+            label += " (" + data[k].Distribution + " " + data[k].Version + ")";
+          }
+          $('#clusters').append(new Option(label, name,false,false));
         }
     }
   });
@@ -0,0 +1,183 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is one record of the audit trail: who did what, from where and how it ended.
+type Event struct {
+	Time     time.Time `json:"@timestamp"`
+	Action   string    `json:"action"`
+	User     string    `json:"user"`
+	IP       string    `json:"ip"`
+	Cluster  string    `json:"cluster,omitempty"`
+	Repo     string    `json:"repo,omitempty"`
+	Snapshot string    `json:"snapshot,omitempty"`
+	Index    string    `json:"index,omitempty"`
+	Indices  []string  `json:"indices,omitempty"`
+	Query    string    `json:"query,omitempty"`
+	File     string    `json:"file,omitempty"`
+	Rows     int64     `json:"rows,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Status   int       `json:"status"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type Sink interface {
+	Write(e Event) error
+}
+
+type Logger struct {
+	sinks []Sink
+}
+
+func New(sinks ...Sink) *Logger {
+	return &Logger{sinks: sinks}
+}
+
+// Close closes the sinks that hold resources, e.g. files
+func (l *Logger) Close() {
+	if l == nil {
+		return
+	}
+	for _, s := range l.sinks {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Println("audit:", err)
+			}
+		}
+	}
+}
+
+// Record passes the event to every sink. A nil Logger means audit is disabled.
+func (l *Logger) Record(e Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	for _, s := range l.sinks {
+		if err := s.Write(e); err != nil {
+			log.Println("audit:", err)
+		}
+	}
+}
+
+// FileSink appends events as JSON lines and rotates the file when it grows over maxSize bytes.
+// Rotated files are kept as <path>.<time>. With maxBackups 0 nothing is ever deleted, otherwise
+// only the maxBackups newest rotated files are kept and the older ones are removed.
+type FileSink struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = fi.Size()
+	return nil
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, s.path+"."+time.Now().UTC().Format(rotateLayout)); err != nil {
+		return err
+	}
+	if s.maxBackups > 0 {
+		s.prune()
+	}
+	return s.open()
+}
+
+const rotateLayout = "20060102T150405.000"
+
+// prune removes the oldest rotated files over maxBackups; only the files named by rotate are touched
+func (s *FileSink) prune() {
+	files, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		log.Println("audit:", err)
+		return
+	}
+	var rotated []string
+	for _, f := range files {
+		if _, err := time.Parse(rotateLayout, strings.TrimPrefix(f, s.path+".")); err == nil {
+			rotated = append(rotated, f)
+		}
+	}
+	// время в имени сортируется как строка
+	sort.Strings(rotated)
+	for len(rotated) > s.maxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			log.Println("audit:", err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+func (s *FileSink) Write(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+	// событие, пришедшее после Close (например, во время перезагрузки конфига), не теряем
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotate(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		writes     int
+		rotated    int
+	}{
+		// с maxBackups 0 ничего не удаляется
+		{"keep all", 0, 5, 4},
+		{"keep two", 2, 5, 2},
+		{"no rotation yet", 2, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "audit.jsonl")
+			// чужой файл рядом с журналом не трогается
+			other := path + ".old"
+			if err := os.WriteFile(other, []byte("x"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			// каждое событие больше maxSize, поэтому каждая следующая запись ротирует файл
+			s, err := NewFileSink(path, 10, tt.maxBackups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			for i := 0; i < tt.writes; i++ {
+				if err := s.Write(Event{Action: "restore", User: "u"}); err != nil {
+					t.Fatal(err)
+				}
+				// имена ротированных файлов различаются по миллисекундам
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			files, _ := filepath.Glob(path + ".2*")
+			if len(files) != tt.rotated {
+				t.Errorf("%d rotated files, want %d: %v", len(files), tt.rotated, files)
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Errorf("unrelated file removed: %s", err)
+			}
+			if fi, err := os.Stat(path); err != nil || fi.Size() == 0 {
+				t.Errorf("current file is missing or empty: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package catalog
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Index is an index stored in a snapshot
+type Index struct {
+	Name   string `json:"index"`
+	Size   int64  `json:"size_in_bytes"`
+	Shards int    `json:"shards"`
+}
+
+// Snapshot is what the catalog keeps about one snapshot
+type Snapshot struct {
+	Cluster          string  `json:"cluster"`
+	Repo             string  `json:"repository"`
+	Name             string  `json:"snapshot"`
+	Uuid             string  `json:"uuid"`
+	State            string  `json:"state"`
+	StartTime        int64   `json:"start_time_in_millis"`
+	EndTime          int64   `json:"end_time_in_millis"`
+	Duration         int64   `json:"duration_in_millis"`
+	ShardsTotal      int     `json:"shards_total"`
+	ShardsSuccessful int     `json:"shards_successful"`
+	ShardsFailed     int     `json:"shards_failed"`
+	Failures         int     `json:"failures"`
+	Indices          []Index `json:"indices"`
+	// Pending is set when the sizes could not be read: the snapshot is kept with the index
+	// names from the listing and read again on the next refresh
+	Pending bool `json:"pending,omitempty"`
+	// Details is false when the listing gave only the index names
+	// and the sizes have to be read with Source.Indices
+	Details bool `json:"-"`
+}
+
+// Source reads the snapshots from the clusters
+type Source interface {
+	Repositories(cluster string) ([]string, error)
+	// Snapshots lists the finished snapshots of the repository
+	Snapshots(cluster, repo string) ([]Snapshot, error)
+	// Indices reads the sizes and shard counts of the indices of one snapshot
+	Indices(cluster, repo, snapshot string) ([]Index, error)
+}
+
+// Match is an index found in a snapshot
+type Match struct {
+	Cluster   string `json:"cluster"`
+	Repo      string `json:"repository"`
+	Snapshot  string `json:"snapshot"`
+	Uuid      string `json:"uuid"`
+	State     string `json:"state"`
+	StartTime int64  `json:"start_time_in_millis"`
+	Pending   bool   `json:"pending,omitempty"` // размер еще не прочитан
+	Index
+}
+
+type repoKey struct {
+	cluster string
+	repo    string
+}
+
+// repoEntry is the content of one repository as of the time it was read
+type repoEntry struct {
+	snaps     map[string]Snapshot
+	refreshed time.Time
+}
+
+// Catalog is the list of indices of every snapshot of the clusters. It is kept in memory,
+// saved to a local file when a path is given, and updated in the background with Refresh,
+// so lookups do not have to ask every snapshot.
+type Catalog struct {
+	src     Source
+	store   *store
+	refresh sync.Mutex
+	sync.RWMutex
+	repos map[repoKey]*repoEntry
+	built time.Time
+}
+
+// Open creates the catalog. With a non-empty path the catalog is kept in that file and
+// what was saved there is available right away, before the first Refresh.
+func Open(src Source, path string) (*Catalog, error) {
+	c := &Catalog{src: src, repos: make(map[repoKey]*repoEntry)}
+	if path == "" {
+		return c, nil
+	}
+	st, err := openStore(path)
+	if err != nil {
+		return nil, err
+	}
+	c.store = st
+	c.repos, err = st.load()
+	if err != nil {
+		st.close()
+		return nil, err
+	}
+	for _, e := range c.repos {
+		if e.refreshed.After(c.built) {
+			c.built = e.refreshed
+		}
+	}
+	return c, nil
+}
+
+func (c *Catalog) Close() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.close()
+}
+
+// Refresh brings the catalog up to date with the clusters. A snapshot never changes, so
+// only the ones not seen before (by uuid) or still pending are read; deleted snapshots, repositories and
+// clusters are dropped. Every repository is saved as soon as it is read. A cluster or
+// repository that cannot be read keeps its entries and their old refresh time.
+func (c *Catalog) Refresh(clusters []string) error {
+	c.refresh.Lock()
+	defer c.refresh.Unlock()
+
+	var errs []error
+	seen := make(map[repoKey]bool)
+	for _, cl := range clusters {
+		repos, err := c.src.Repositories(cl)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", cl, err))
+			c.RLock()
+			for k := range c.repos {
+				if k.cluster == cl {
+					seen[k] = true
+				}
+			}
+			c.RUnlock()
+			continue
+		}
+		for _, repo := range repos {
+			k := repoKey{cluster: cl, repo: repo}
+			seen[k] = true
+			if err := c.refreshRepo(k); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	c.Lock()
+	for k := range c.repos {
+		if !seen[k] {
+			delete(c.repos, k)
+			if c.store != nil {
+				if err := c.store.dropRepo(k); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+	c.built = time.Now()
+	c.Unlock()
+	return errors.Join(errs...)
+}
+
+func (c *Catalog) refreshRepo(k repoKey) error {
+	list, err := c.src.Snapshots(k.cluster, k.repo)
+	if err != nil {
+		return fmt.Errorf("cluster %s, repository %s: %w", k.cluster, k.repo, err)
+	}
+
+	c.RLock()
+	old := c.repos[k]
+	c.RUnlock()
+
+	var errs []error
+	next := &repoEntry{snaps: make(map[string]Snapshot), refreshed: time.Now()}
+	var added []Snapshot
+	for _, s := range list {
+		if old != nil {
+			if o, ok := old.snaps[s.Name]; ok && o.Uuid == s.Uuid && !o.Pending {
+				next.snaps[s.Name] = o
+				continue
+			}
+		}
+		s.Pending = false
+		if !s.Details {
+			indices, err := c.src.Indices(k.cluster, k.repo, s.Name)
+			if err != nil {
+				// оставляем имена индексов из списка, размеры прочитаем при следующем обновлении
+				errs = append(errs, fmt.Errorf("cluster %s, snapshot %s/%s: %w", k.cluster, k.repo, s.Name, err))
+				s.Pending = true
+			} else {
+				s.Indices, s.Details = indices, true
+			}
+		}
+		s.Cluster, s.Repo = k.cluster, k.repo
+		next.snaps[s.Name] = s
+		added = append(added, s)
+	}
+	var removed []string
+	if old != nil {
+		for name := range old.snaps {
+			if _, ok := next.snaps[name]; !ok {
+				removed = append(removed, name)
+			}
+		}
+	}
+
+	if c.store != nil {
+		if err := c.store.saveRepo(k, added, removed, next.refreshed); err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s, repository %s: cannot save: %w", k.cluster, k.repo, err))
+		}
+	}
+	c.Lock()
+	c.repos[k] = next
+	c.Unlock()
+	return errors.Join(errs...)
+}
+
+// Built returns the time of the last refresh, zero if there was none yet
+func (c *Catalog) Built() time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	return c.built
+}
+
+// Freshness returns the oldest time a repository of the cluster (of all clusters when
+// cluster is empty) was read, so everything the catalog answers is at least that fresh
+func (c *Catalog) Freshness(cluster string) time.Time {
+	c.RLock()
+	defer c.RUnlock()
+	var t time.Time
+	for k, e := range c.repos {
+		if cluster != "" && k.cluster != cluster {
+			continue
+		}
+		if t.IsZero() || e.refreshed.Before(t) {
+			t = e.refreshed
+		}
+	}
+	return t
+}
+
+// Len returns the number of snapshots in the catalog
+func (c *Catalog) Len() int {
+	c.RLock()
+	defer c.RUnlock()
+	n := 0
+	for _, e := range c.repos {
+		n += len(e.snaps)
+	}
+	return n
+}
+
+// Snapshots returns the snapshots of the repository by start time and the time
+// the repository was read; ok is false when the catalog does not have it
+func (c *Catalog) Snapshots(cluster, repo string) (res []Snapshot, refreshed time.Time, ok bool) {
+	c.RLock()
+	defer c.RUnlock()
+	e, ok := c.repos[repoKey{cluster: cluster, repo: repo}]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	for _, s := range e.snaps {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].StartTime != res[j].StartTime {
+			return res[i].StartTime < res[j].StartTime
+		}
+		return res[i].Name < res[j].Name
+	})
+	return res, e.refreshed, true
+}
+
+// Snapshot returns one snapshot and the time its repository was read
+func (c *Catalog) Snapshot(cluster, repo, name string) (Snapshot, time.Time, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	e, ok := c.repos[repoKey{cluster: cluster, repo: repo}]
+	if !ok {
+		return Snapshot{}, time.Time{}, false
+	}
+	s, ok := e.snaps[name]
+	return s, e.refreshed, ok
+}
+
+// Find returns the indices matching the pattern (index name, * wildcards, comma separated
+// list) in the snapshots of the cluster, or of all clusters when cluster is empty.
+// The newest snapshots come first.
+func (c *Catalog) Find(cluster, pattern string) []Match {
+	var patterns []string
+	for _, p := range strings.Split(pattern, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+
+	c.RLock()
+	var res []Match
+	for k, e := range c.repos {
+		if cluster != "" && k.cluster != cluster {
+			continue
+		}
+		for _, s := range e.snaps {
+			for _, idx := range s.Indices {
+				if !MatchName(patterns, idx.Name) {
+					continue
+				}
+				res = append(res, Match{
+					Cluster:   s.Cluster,
+					Repo:      s.Repo,
+					Snapshot:  s.Name,
+					Uuid:      s.Uuid,
+					State:     s.State,
+					StartTime: s.StartTime,
+					Pending:   s.Pending,
+					Index:     idx,
+				})
+			}
+		}
+	}
+	c.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.StartTime != b.StartTime {
+			return a.StartTime > b.StartTime
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		if a.Snapshot != b.Snapshot {
+			return a.Snapshot < b.Snapshot
+		}
+		return a.Name < b.Name
+	})
+	return res
+}
+
+// MatchName reports whether the name matches one of the patterns with * wildcards
+func MatchName(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package catalog
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSource serves fixed snapshots; statusErr makes Indices fail for the named snapshots
+type fakeSource struct {
+	snaps     map[string][]Snapshot // по репозиториям
+	indices   map[string][]Index    // по снапшотам
+	statusErr map[string]bool
+	calls     map[string]int
+}
+
+func (f *fakeSource) Repositories(cluster string) ([]string, error) {
+	var l []string
+	for r := range f.snaps {
+		l = append(l, r)
+	}
+	return l, nil
+}
+
+func (f *fakeSource) Snapshots(cluster, repo string) ([]Snapshot, error) {
+	return f.snaps[repo], nil
+}
+
+func (f *fakeSource) Indices(cluster, repo, snapshot string) ([]Index, error) {
+	f.calls[snapshot]++
+	if f.statusErr[snapshot] {
+		return nil, errors.New("timeout")
+	}
+	return f.indices[snapshot], nil
+}
+
+func TestRefreshPending(t *testing.T) {
+	src := &fakeSource{
+		snaps: map[string][]Snapshot{"r1": {
+			{Name: "s1", Uuid: "u1", StartTime: 1, Indices: []Index{{Name: "logs"}}},
+			{Name: "s2", Uuid: "u2", StartTime: 2, Indices: []Index{{Name: "logs"}, {Name: "audit"}}},
+		}},
+		indices: map[string][]Index{
+			"s1": {{Name: "logs", Size: 10, Shards: 1}},
+			"s2": {{Name: "logs", Size: 20, Shards: 1}, {Name: "audit", Size: 5, Shards: 1}},
+		},
+		statusErr: map[string]bool{"s2": true},
+		calls:     make(map[string]int),
+	}
+	path := filepath.Join(t.TempDir(), "catalog.db")
+	c, err := Open(src, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Refresh([]string{"es"}); err == nil {
+		t.Error("the failed status is not reported")
+	}
+	s, _, ok := c.Snapshot("es", "r1", "s2")
+	if !ok || !s.Pending || len(s.Indices) != 2 || s.Indices[0].Size != 0 {
+		t.Fatalf("s2 not kept as pending: %+v", s)
+	}
+	if got := len(c.Find("", "audit")); got != 1 {
+		t.Errorf("pending snapshot not found by index, %d matches", got)
+	}
+
+	// после перезапуска pending снапшот снова читается, готовый - нет
+	c.Close()
+	if c, err = Open(src, path); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	delete(src.statusErr, "s2")
+	if err := c.Refresh([]string{"es"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _, _ = c.Snapshot("es", "r1", "s2"); s.Pending || s.Indices[0].Size != 20 {
+		t.Errorf("s2 not read again: %+v", s)
+	}
+	if src.calls["s1"] != 1 || src.calls["s2"] != 2 {
+		t.Errorf("status calls %v, want s1 once and s2 twice", src.calls)
+	}
+}
+
+func TestFind(t *testing.T) {
+	c := &Catalog{repos: map[repoKey]*repoEntry{
+		{cluster: "a", repo: "s3"}: {snaps: map[string]Snapshot{
+			"d1": {Cluster: "a", Repo: "s3", Name: "d1", StartTime: 1, Indices: []Index{{Name: "logs-2024.03.01"}, {Name: "audit"}}},
+			"d2": {Cluster: "a", Repo: "s3", Name: "d2", StartTime: 2, Indices: []Index{{Name: "logs-2024.03.02"}, {Name: "audit"}}},
+		}},
+		{cluster: "b", repo: "fs"}: {snaps: map[string]Snapshot{
+			"d2": {Cluster: "b", Repo: "fs", Name: "d2", StartTime: 2, Indices: []Index{{Name: "logs-2024.03.02"}}},
+		}},
+	}}
+
+	tests := []struct {
+		cluster string
+		pattern string
+		want    []string // cluster/repo/snapshot/index в порядке ответа
+	}{
+		{"", "audit", []string{"a/s3/d2/audit", "a/s3/d1/audit"}},
+		{"", "logs-2024.03.02", []string{"a/s3/d2/logs-2024.03.02", "b/fs/d2/logs-2024.03.02"}},
+		{"b", "logs-*", []string{"b/fs/d2/logs-2024.03.02"}},
+		{"a", " logs-*.01 , audit ", []string{"a/s3/d2/audit", "a/s3/d1/audit", "a/s3/d1/logs-2024.03.01"}},
+		{"", "metrics-*", nil},
+		{"c", "*", nil},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, m := range c.Find(tt.cluster, tt.pattern) {
+			got = append(got, m.Cluster+"/"+m.Repo+"/"+m.Snapshot+"/"+m.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Find(%q, %q) = %v, want %v", tt.cluster, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{[]string{"logs-*"}, "logs-2024.03.01", true},
+		{[]string{"logs"}, "logs-2024.03.01", false},
+		{[]string{"audit", "logs-*"}, "logs-x", true},
+		{[]string{"*"}, ".kibana", true},
+		{[]string{"logs-[0-9]*"}, "logs-2024", true},
+		{nil, "logs", false},
+	}
+	for _, tt := range tests {
+		if got := MatchName(tt.patterns, tt.name); got != tt.want {
+			t.Errorf("MatchName(%v, %q) = %v, want %v", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package catalog
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Файл каталога: в bucket snapshots ключ cluster\x00repo\x00snapshot, значение - Snapshot в JSON,
+// в bucket repos ключ cluster\x00repo, значение - время последнего чтения репозитория
+var (
+	bucketSnapshots = []byte("snapshots")
+	bucketRepos     = []byte("repos")
+)
+
+type store struct {
+	db *bolt.DB
+}
+
+func openStore(path string) (*store, error) {
+	// файл занят другим процессом - не ждем вечно
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{bucketSnapshots, bucketRepos} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &store{db: db}, nil
+}
+
+func (st *store) close() error {
+	return st.db.Close()
+}
+
+func (k repoKey) prefix() []byte {
+	return []byte(k.cluster + "\x00" + k.repo + "\x00")
+}
+
+func (k repoKey) id() []byte {
+	return []byte(k.cluster + "\x00" + k.repo)
+}
+
+func (st *store) load() (map[repoKey]*repoEntry, error) {
+	repos := make(map[repoKey]*repoEntry)
+	err := st.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(bucketRepos).ForEach(func(k, v []byte) error {
+			cluster, repo, _ := strings.Cut(string(k), "\x00")
+			var t time.Time
+			if err := t.UnmarshalText(v); err != nil {
+				return err
+			}
+			repos[repoKey{cluster: cluster, repo: repo}] = &repoEntry{snaps: make(map[string]Snapshot), refreshed: t}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketSnapshots).ForEach(func(k, v []byte) error {
+			var s Snapshot
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			e, ok := repos[repoKey{cluster: s.Cluster, repo: s.Repo}]
+			if !ok {
+				return nil
+			}
+			s.Details = true
+			e.snaps[s.Name] = s
+			return nil
+		})
+	})
+	return repos, err
+}
+
+// saveRepo stores the changes of one repository in a single transaction
+func (st *store) saveRepo(k repoKey, added []Snapshot, removed []string, refreshed time.Time) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketSnapshots)
+		for _, name := range removed {
+			if err := b.Delete(append(k.prefix(), name...)); err != nil {
+				return err
+			}
+		}
+		for _, s := range added {
+			v, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(append(k.prefix(), s.Name...), v); err != nil {
+				return err
+			}
+		}
+		t, err := refreshed.MarshalText()
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucketRepos).Put(k.id(), t)
+	})
+}
+
+func (st *store) dropRepo(k repoKey) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketSnapshots).Cursor()
+		p := k.prefix()
+		for key, _ := c.Seek(p); key != nil && strings.HasPrefix(string(key), string(p)); key, _ = c.Seek(p) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(bucketRepos).Delete(k.id())
+	})
+}
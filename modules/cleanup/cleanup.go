@@ -18,6 +18,8 @@ import (
 	"log"
 	"os"
 	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/metrics"
 )
 
 var cutoff = 1 * time.Hour
@@ -39,6 +41,7 @@ func Run() {
 					log.Println(err)
 					return
 				}
+				metrics.CleanupDeleted.Inc()
 			}
 		}
 
@@ -14,67 +14,205 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
+	"os"
 	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
 	App struct {
-		Port       string `yaml:"port"`
-		Bind       string `yaml:"bind"`
-		Kibana     string `yaml:"kibana"`
-		TimeOut    int    `yaml:"-"`
-		TimeOutRaw *int   `yaml:"timeout"`
+		Port            string `yaml:"port"`
+		Bind            string `yaml:"bind"`
+		Kibana          string `yaml:"kibana"`
+		TimeOut         int    `yaml:"-"`
+		TimeOutRaw      *int   `yaml:"timeout"`
+		ReadyCache      int    `yaml:"ready_cache"`
+		ReadyTimeout    int    `yaml:"ready_timeout"`
+		ShutdownTimeout int    `yaml:"shutdown_timeout"`
+		ReloadInterval  int    `yaml:"reload_interval"`
+		SnapshotCache   int    `yaml:"snapshot_cache_ttl"`
+		TLS             struct {
+			Cert       string `yaml:"cert"`
+			Key        string `yaml:"key"`
+			MinVersion string `yaml:"min_version"`
+			ClientCA   string `yaml:"client_ca"`
+			ClientAuth string `yaml:"client_auth"`
+		} `yaml:"tls"`
 	} `yaml:"app"`
-	Snapshot struct {
-		Host               string `yaml:"host"`
-		Name               string `yaml:"name,omitempty"`
-		SSL                bool   `yaml:"ssl"`
-		Username           string `yaml:"username"`
-		Password           string `yaml:"password"`
-		CAcert             string `yaml:"ca_cert"`
-		ClientCert         string `yaml:"client_cert"`
-		ClientKey          string `yaml:"client_key"`
-		InsecureSkipVerify bool   `yaml:"insecure"`
-		Include            bool   `yaml:"include_system"`
-		IsS3               bool   `yaml:"is_s3"`
-	} `yaml:"snapshot"`
-	Search struct {
-		Host               string `yaml:"host,omitempty"`
-		Name               string `yaml:"name,omitempty"`
-		RequestBatch       int64  `yaml:"request_batch,omitempty"`
-		SSL                bool   `yaml:"ssl,omitempty"`
-		Username           string `yaml:"username,omitempty"`
-		Password           string `yaml:"password,omitempty"`
-		CAcert             string `yaml:"ca_cert,omitempty"`
-		ClientCert         string `yaml:"client_cert,omitempty"`
-		ClientKey          string `yaml:"client_key,omitempty"`
-		InsecureSkipVerify bool   `yaml:"insecure,omitempty"`
-		FileLimit          struct {
-			Rows    int    `yaml:"-"`
-			RowsRaw *int   `yaml:"rows,omitempty"`
-			Size    int64  `yaml:"-"`
-			SizeRaw *int64 `yaml:"size,omitempty"`
-		} `yaml:"file_limit,omitempty"`
-	} `yaml:"search,omitempty"`
+	// snapshot и search - старый формат описания кластеров, используется если clusters не задан
+	Snapshot Cluster   `yaml:"snapshot"`
+	Search   Cluster   `yaml:"search,omitempty"`
+	Clusters []Cluster `yaml:"clusters,omitempty"`
+	Audit    struct {
+		File    string `yaml:"file,omitempty"`
+		MaxSize int64  `yaml:"max_size,omitempty"`
+		// старые ротированные файлы удаляются, только если явно задан delete_rotated
+		MaxBackups    int    `yaml:"max_backups,omitempty"`
+		DeleteRotated bool   `yaml:"delete_rotated,omitempty"`
+		Index         string `yaml:"index,omitempty"`
+		Cluster       string `yaml:"cluster,omitempty"`
+		// имя пользователя из заголовка принимается только от trusted_proxies (IP или CIDR)
+		UserHeader     string   `yaml:"user_header,omitempty"`
+		TrustedProxies []string `yaml:"trusted_proxies,omitempty"`
+	} `yaml:"audit,omitempty"`
+	// каталог индексов в снапшотах для find_index
+	Catalog struct {
+		Interval int    `yaml:"interval,omitempty"`
+		Path     string `yaml:"path,omitempty"` // файл каталога; без него каталог только в памяти
+	} `yaml:"catalog,omitempty"`
 }
 
-func Parse(f string) Config {
+const (
+	RoleRestore = "restore"
+	RoleSearch  = "search"
+)
+
+// Retry describes how idempotent requests are repeated on network errors and
+// retryable statuses; backoff values are in milliseconds
+type Retry struct {
+	MaxAttempts int   `yaml:"max_attempts,omitempty"`
+	Backoff     int   `yaml:"backoff,omitempty"`
+	MaxBackoff  int   `yaml:"max_backoff,omitempty"`
+	Statuses    []int `yaml:"statuses,omitempty"`
+}
+
+// SnapshotPattern extracts the snapshot date from its name: Regex must have a capture
+// group named date (or the date is taken from the last group) parsed with the Go time Layout
+type SnapshotPattern struct {
+	Name   string `yaml:"name"`
+	Regex  string `yaml:"regex"`
+	Layout string `yaml:"layout"`
+}
+
+// DefaultSnapshotPattern matches names like logs-2024.05.01 as the extractor always did
+var DefaultSnapshotPattern = SnapshotPattern{Name: "default", Regex: `^(.*)-(\d{4}\.\d{2}\.\d{2})`, Layout: "2006.01.02"}
+
+// Transport tunes the HTTP client of a cluster; timeouts are in seconds.
+// ExportTimeout replaces RequestTimeout for scroll requests used by exports.
+type Transport struct {
+	ConnectTimeout        int    `yaml:"connect_timeout,omitempty"`
+	TLSHandshakeTimeout   int    `yaml:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout int    `yaml:"response_header_timeout,omitempty"`
+	RequestTimeout        int    `yaml:"request_timeout,omitempty"`
+	ExportTimeout         int    `yaml:"export_timeout,omitempty"`
+	MaxIdleConns          int    `yaml:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost   int    `yaml:"max_idle_conns_per_host,omitempty"`
+	MaxConnsPerHost       int    `yaml:"max_conns_per_host,omitempty"`
+	IdleConnTimeout       int    `yaml:"idle_conn_timeout,omitempty"`
+	KeepAlive             int    `yaml:"keep_alive,omitempty"`
+	DisableKeepAlives     bool   `yaml:"disable_keep_alives,omitempty"`
+	Proxy                 string `yaml:"proxy,omitempty"`
+}
+
+// SigV4 enables AWS request signing for managed OpenSearch domains (service es)
+// and OpenSearch Serverless collections (service aoss)
+type SigV4 struct {
+	Enabled          bool   `yaml:"enabled,omitempty"`
+	Region           string `yaml:"region,omitempty"`
+	Service          string `yaml:"service,omitempty"`
+	AccessKey        string `yaml:"access_key,omitempty"`
+	AccessKeyFile    string `yaml:"access_key_file,omitempty"`
+	SecretKey        string `yaml:"secret_key,omitempty"`
+	SecretKeyFile    string `yaml:"secret_key_file,omitempty"`
+	SessionToken     string `yaml:"session_token,omitempty"`
+	SessionTokenFile string `yaml:"session_token_file,omitempty"`
+	Profile          string `yaml:"profile,omitempty"`
+}
+
+type Cluster struct {
+	Name               string            `yaml:"name,omitempty"`
+	Host               string            `yaml:"host,omitempty"`
+	Hosts              []string          `yaml:"hosts,omitempty"`
+	Sniff              bool              `yaml:"sniff,omitempty"`
+	SniffInterval      int               `yaml:"sniff_interval,omitempty"`
+	DeadTimeout        int               `yaml:"dead_timeout,omitempty"`
+	Retry              Retry             `yaml:"retry,omitempty"`
+	Transport          Transport         `yaml:"transport,omitempty"`
+	SnapshotPatterns   []SnapshotPattern `yaml:"snapshot_patterns,omitempty"`
+	Roles              []string          `yaml:"roles,omitempty"`
+	SSL                bool              `yaml:"ssl,omitempty"`
+	Username           string            `yaml:"username,omitempty"`
+	UsernameFile       string            `yaml:"username_file,omitempty"`
+	Password           string            `yaml:"password,omitempty"`
+	PasswordFile       string            `yaml:"password_file,omitempty"`
+	ApiKey             string            `yaml:"api_key,omitempty"`
+	ApiKeyFile         string            `yaml:"api_key_file,omitempty"`
+	ApiKeyEnv          string            `yaml:"api_key_env,omitempty"`
+	BearerToken        string            `yaml:"bearer_token,omitempty"`
+	BearerTokenFile    string            `yaml:"bearer_token_file,omitempty"`
+	BearerTokenEnv     string            `yaml:"bearer_token_env,omitempty"`
+	ServiceToken       string            `yaml:"service_token,omitempty"`
+	ServiceTokenFile   string            `yaml:"service_token_file,omitempty"`
+	ServiceTokenEnv    string            `yaml:"service_token_env,omitempty"`
+	SigV4              SigV4             `yaml:"sigv4,omitempty"`
+	CAcert             string            `yaml:"ca_cert,omitempty"`
+	ClientCert         string            `yaml:"client_cert,omitempty"`
+	ClientKey          string            `yaml:"client_key,omitempty"`
+	InsecureSkipVerify bool              `yaml:"insecure,omitempty"`
+	Include            bool              `yaml:"include_system,omitempty"`
+	IsS3               bool              `yaml:"is_s3,omitempty"`
+	StaleAfter         int               `yaml:"stale_after,omitempty"`
+	RequestBatch       int64             `yaml:"request_batch,omitempty"`
+	FileLimit          struct {
+		Rows    int    `yaml:"-"`
+		RowsRaw *int   `yaml:"rows,omitempty"`
+		Size    int64  `yaml:"-"`
+		SizeRaw *int64 `yaml:"size,omitempty"`
+	} `yaml:"file_limit,omitempty"`
+}
+
+func (c Cluster) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Cluster) CanRestore() bool {
+	return c.HasRole(RoleRestore)
+}
+
+func (c Cluster) CanSearch() bool {
+	return c.HasRole(RoleSearch)
+}
+
+// Parse reads the config file, applies defaults and validates the result. All problems
+// found are returned together; the config is returned even if it is invalid.
+func Parse(f string) (Config, error) {
 	var c Config
+	var errs []error
 	var re = regexp.MustCompile(`(?m)^https*://(?P<host>[\w\d-\._]+)*:*[\d]*/*$`)
 	template := []byte("$host\n")
 
 	yamlBytes, err := ioutil.ReadFile(f)
 	if err != nil {
-		log.Fatal(err)
+		return c, err
+	}
+
+	// неизвестные ключи и ошибки типов yaml возвращает списком, синтаксические - одной ошибкой
+	err = yaml.UnmarshalStrict(yamlBytes, &c)
+	if err != nil {
+		var te *yaml.TypeError
+		if !errors.As(err, &te) {
+			return c, err
+		}
+		for _, e := range te.Errors {
+			errs = append(errs, errors.New(e))
+		}
 	}
 
-	err = yaml.Unmarshal(yamlBytes, &c)
+	errs = append(errs, expandEnv(&c)...)
+
+	err = applyEnvOverrides(&c)
 	if err != nil {
-		log.Fatal(err)
+		errs = append(errs, err)
 	}
 
 	if c.App.Port == "" {
@@ -90,35 +228,184 @@ func Parse(f string) Config {
 		c.App.TimeOut = *c.App.TimeOutRaw
 	}
 
-	if c.Snapshot.Host == "" {
-		c.Snapshot.Host = "http://127.0.0.1:9200/"
+	if c.App.ShutdownTimeout == 0 {
+		c.App.ShutdownTimeout = 60
+	}
+
+	if c.App.ReadyCache == 0 {
+		c.App.ReadyCache = 10
 	}
-	if c.Snapshot.Name == "" {
-		s0 := re.FindSubmatchIndex([]byte(c.Snapshot.Host))
-		c.Snapshot.Name = string(re.Expand([]byte{}, template, []byte(c.Snapshot.Host), s0))
+
+	if c.App.ReadyTimeout == 0 {
+		c.App.ReadyTimeout = 5
 	}
 
-	if c.Search.Host == "" {
-		c.Search.Host = "http://127.0.0.1:9200/"
+	if c.App.ReloadInterval == 0 {
+		c.App.ReloadInterval = 10
 	}
-	if c.Search.Name == "" {
-		s1 := re.FindSubmatchIndex([]byte(c.Search.Host))
-		c.Search.Name = string(re.Expand([]byte{}, template, []byte(c.Search.Host), s1))
+
+	if c.App.SnapshotCache == 0 {
+		c.App.SnapshotCache = 60
+	}
+
+	legacy := len(c.Clusters) == 0
+	if legacy {
+		if c.Snapshot.Host == "" {
+			c.Snapshot.Host = "http://127.0.0.1:9200/"
+		}
+		if c.Search.Host == "" {
+			c.Search.Host = "http://127.0.0.1:9200/"
+		}
+		c.Snapshot.Roles = []string{RoleRestore}
+		c.Search.Roles = []string{RoleSearch}
+		c.Clusters = []Cluster{c.Snapshot, c.Search}
+	}
+
+	names := make(map[string]bool)
+	for i := range c.Clusters {
+		cl := &c.Clusters[i]
+		if len(cl.Hosts) == 0 {
+			cl.Hosts = []string{cl.Host}
+		}
+		for j := range cl.Hosts {
+			if !strings.HasSuffix(cl.Hosts[j], "/") {
+				cl.Hosts[j] += "/"
+			}
+		}
+		cl.Host = cl.Hosts[0]
+
+		for _, s := range []struct {
+			value     *string
+			file, env string
+		}{
+			{&cl.Username, cl.UsernameFile, ""},
+			{&cl.Password, cl.PasswordFile, ""},
+			{&cl.SigV4.AccessKey, cl.SigV4.AccessKeyFile, ""},
+			{&cl.SigV4.SecretKey, cl.SigV4.SecretKeyFile, ""},
+			{&cl.SigV4.SessionToken, cl.SigV4.SessionTokenFile, ""},
+			{&cl.ApiKey, cl.ApiKeyFile, cl.ApiKeyEnv},
+			{&cl.BearerToken, cl.BearerTokenFile, cl.BearerTokenEnv},
+			{&cl.ServiceToken, cl.ServiceTokenFile, cl.ServiceTokenEnv},
+		} {
+			if err := readSecret(s.value, s.file, s.env); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", clusterPath(legacy, i), err))
+			}
+		}
+		if cl.Name == "" {
+			s0 := re.FindSubmatchIndex([]byte(cl.Host))
+			if s0 != nil {
+				cl.Name = strings.TrimSpace(string(re.Expand([]byte{}, template, []byte(cl.Host), s0)))
+			}
+		}
+		// в старом формате оба кластера могут указывать на один хост
+		if legacy && names[cl.Name] {
+			cl.Name = fmt.Sprintf("%s-%d", cl.Name, i)
+		}
+		names[cl.Name] = true
+
+		if cl.SniffInterval == 0 {
+			cl.SniffInterval = 300
+		}
+
+		if cl.DeadTimeout == 0 {
+			cl.DeadTimeout = 60
+		}
+
+		if cl.StaleAfter == 0 {
+			cl.StaleAfter = 48
+		}
+
+		if cl.SigV4.Enabled {
+			if cl.SigV4.Service == "" {
+				cl.SigV4.Service = "es"
+			}
+			if cl.SigV4.Region == "" {
+				cl.SigV4.Region = os.Getenv("AWS_REGION")
+			}
+			if cl.SigV4.Region == "" {
+				cl.SigV4.Region = os.Getenv("AWS_DEFAULT_REGION")
+			}
+		}
+
+		t := &cl.Transport
+		if t.ConnectTimeout == 0 {
+			t.ConnectTimeout = c.App.TimeOut
+		}
+		if t.TLSHandshakeTimeout == 0 {
+			t.TLSHandshakeTimeout = 10
+		}
+		if t.ResponseHeaderTimeout == 0 {
+			t.ResponseHeaderTimeout = c.App.TimeOut
+		}
+		if t.RequestTimeout == 0 {
+			t.RequestTimeout = c.App.TimeOut
+		}
+		if t.ExportTimeout == 0 {
+			t.ExportTimeout = 600
+		}
+		if t.MaxIdleConns == 0 {
+			t.MaxIdleConns = 100
+		}
+		if t.MaxIdleConnsPerHost == 0 {
+			t.MaxIdleConnsPerHost = 10
+		}
+		if t.IdleConnTimeout == 0 {
+			t.IdleConnTimeout = 90
+		}
+		if t.KeepAlive == 0 {
+			t.KeepAlive = 30
+		}
+
+		if len(cl.SnapshotPatterns) == 0 {
+			cl.SnapshotPatterns = []SnapshotPattern{DefaultSnapshotPattern}
+		}
+
+		if cl.Retry.MaxAttempts == 0 {
+			cl.Retry.MaxAttempts = 3
+		}
+		if cl.Retry.Backoff == 0 {
+			cl.Retry.Backoff = 200
+		}
+		if cl.Retry.MaxBackoff == 0 {
+			cl.Retry.MaxBackoff = 5000
+		}
+		if len(cl.Retry.Statuses) == 0 {
+			cl.Retry.Statuses = []int{429, 502, 503, 504}
+		}
+
+		if len(cl.Roles) == 0 {
+			cl.Roles = []string{RoleRestore, RoleSearch}
+		}
+
+		if cl.RequestBatch == 0 {
+			cl.RequestBatch = 10000
+		}
+
+		cl.FileLimit.Rows = 1000000
+		if cl.FileLimit.RowsRaw != nil {
+			cl.FileLimit.Rows = *cl.FileLimit.RowsRaw
+		}
+
+		cl.FileLimit.Size = 5 * 1024 * 1024 * 1024
+		if cl.FileLimit.SizeRaw != nil {
+			cl.FileLimit.Size = *cl.FileLimit.SizeRaw * 1024 * 1024 * 1024
+		}
 	}
 
-	if c.Search.RequestBatch == 0 {
-		c.Search.RequestBatch = 10000
+	// max_size in Megabytes
+	if c.Audit.MaxSize == 0 {
+		c.Audit.MaxSize = 100
 	}
+	c.Audit.MaxSize = c.Audit.MaxSize * 1024 * 1024
 
-	c.Search.FileLimit.Rows = 1000000
-	if c.Search.FileLimit.RowsRaw != nil {
-		c.Search.FileLimit.Rows = *c.Search.FileLimit.RowsRaw
+	if c.Audit.Cluster == "" {
+		c.Audit.Cluster = c.Clusters[0].Name
 	}
 
-	c.Search.FileLimit.Size = 5 * 1024 * 1024 * 1024
-	if c.Search.FileLimit.SizeRaw != nil {
-		c.Search.FileLimit.Size = *c.Search.FileLimit.SizeRaw * 1024 * 1024 * 1024
+	if c.Catalog.Interval == 0 {
+		c.Catalog.Interval = 600
 	}
 
-	return c
+	errs = append(errs, c.validate(legacy)...)
+	return c, errors.Join(errs...)
 }
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Diff lists the yaml paths of the keys that differ between two parsed configs.
+// Only paths are returned, values are left out so credentials never end up in logs.
+// Clusters are matched by name; snapshot and search are skipped because Parse
+// copies them into clusters.
+func Diff(a, b Config) []string {
+	var d []string
+	diffValue(reflect.ValueOf(a.App), reflect.ValueOf(b.App), "app", &d)
+	diffValue(reflect.ValueOf(a.Audit), reflect.ValueOf(b.Audit), "audit", &d)
+	diffValue(reflect.ValueOf(a.Catalog), reflect.ValueOf(b.Catalog), "catalog", &d)
+
+	old := make(map[string]Cluster)
+	for _, cl := range a.Clusters {
+		old[cl.Name] = cl
+	}
+	for _, cl := range b.Clusters {
+		o, ok := old[cl.Name]
+		if !ok {
+			d = append(d, "clusters."+cl.Name+" (added)")
+			continue
+		}
+		diffValue(reflect.ValueOf(o), reflect.ValueOf(cl), "clusters."+cl.Name, &d)
+		delete(old, cl.Name)
+	}
+	for _, cl := range a.Clusters {
+		if _, ok := old[cl.Name]; ok {
+			d = append(d, "clusters."+cl.Name+" (removed)")
+		}
+	}
+	return d
+}
+
+func diffValue(a, b reflect.Value, path string, d *[]string) {
+	if a.Kind() == reflect.Struct {
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			diffValue(a.Field(i), b.Field(i), path+"."+tag, d)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		*d = append(*d, path)
+	}
+}
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "EXTRACTOR"
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in every string value of the parsed config,
+// so a variable can't inject yaml. A bare $ is left as is so passwords containing it don't
+// need escaping; a variable that is not set and has no default is an error.
+func expandEnv(c *Config) []error {
+	var errs []error
+	expandValue(reflect.ValueOf(c).Elem(), "", &errs)
+	return errs
+}
+
+func expandValue(v reflect.Value, path string, errs *[]error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			expandValue(v.Elem(), path, errs)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			if path != "" {
+				tag = path + "." + tag
+			}
+			expandValue(v.Field(i), tag, errs)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.String:
+		v.SetString(envRef.ReplaceAllStringFunc(v.String(), func(m string) string {
+			sm := envRef.FindStringSubmatch(m)
+			if val, ok := os.LookupEnv(sm[1]); ok {
+				return val
+			}
+			if sm[2] != "" {
+				return sm[3]
+			}
+			*errs = append(*errs, fmt.Errorf("%s: environment variable %s is not set", path, sm[1]))
+			return ""
+		}))
+	}
+}
+
+// readSecret fills an empty credential from a file or an environment variable
+func readSecret(value *string, file, env string) error {
+	if *value != "" {
+		return nil
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		*value = strings.TrimSpace(string(b))
+		return nil
+	}
+	if env != "" {
+		*value = os.Getenv(env)
+		if *value == "" {
+			return fmt.Errorf("environment variable %s is empty", env)
+		}
+	}
+	return nil
+}
+
+// applyEnvOverrides sets any config key from an EXTRACTOR_<PATH> variable, where the path is
+// made of the upper-cased yaml keys: EXTRACTOR_APP_PORT, EXTRACTOR_SNAPSHOT_HOST,
+// EXTRACTOR_CLUSTERS_0_PASSWORD. Lists are comma separated.
+func applyEnvOverrides(c *Config) error {
+	return overrideValue(reflect.ValueOf(c).Elem(), envPrefix)
+}
+
+func overrideValue(v reflect.Value, name string) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if tag == "" || tag == "-" {
+				continue
+			}
+			if err := overrideValue(v.Field(i), name+"_"+strings.ToUpper(tag)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Struct {
+			for i := 0; i < v.Len(); i++ {
+				if err := overrideValue(v.Index(i), name+"_"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	env, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	if err := setValue(v, env); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := setValue(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Slice:
+		l := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := setValue(e, strings.TrimSpace(item)); err != nil {
+				return err
+			}
+			l = reflect.Append(l, e)
+		}
+		v.Set(l)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("EXT_TEST_PASS", "p@ss\nsniff: true")
+	t.Setenv("EXT_TEST_EMPTY", "")
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		err   string
+	}{
+		{"plain", "admin", "admin", ""},
+		{"bare dollar", "pa$$word", "pa$$word", ""},
+		{"set", "${EXT_TEST_PASS}", "p@ss\nsniff: true", ""},
+		{"inside text", "https://${EXT_TEST_PASS}@x", "https://p@ss\nsniff: true@x", ""},
+		{"set but empty", "${EXT_TEST_EMPTY}", "", ""},
+		{"default unused", "${EXT_TEST_PASS:-other}", "p@ss\nsniff: true", ""},
+		{"default", "${EXT_TEST_UNSET:-admin}", "admin", ""},
+		{"empty default", "${EXT_TEST_UNSET:-}", "", ""},
+		{"unset", "${EXT_TEST_UNSET}", "", "clusters[0].password: environment variable EXT_TEST_UNSET is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Config{Clusters: []Cluster{{Password: tt.value}}}
+			errs := expandEnv(&c)
+			if c.Clusters[0].Password != tt.want {
+				t.Errorf("got %q, want %q", c.Clusters[0].Password, tt.want)
+			}
+			if tt.err == "" && len(errs) != 0 {
+				t.Errorf("unexpected errors %v", errs)
+			}
+			if tt.err != "" && (len(errs) != 1 || errs[0].Error() != tt.err) {
+				t.Errorf("got errors %v, want %q", errs, tt.err)
+			}
+		})
+	}
+}
+
+func TestExpandEnvLists(t *testing.T) {
+	t.Setenv("EXT_TEST_HOST", "es1:9200")
+	c := Config{Clusters: []Cluster{{Hosts: []string{"${EXT_TEST_HOST}", "${EXT_TEST_UNSET}"}}}}
+	errs := expandEnv(&c)
+	if c.Clusters[0].Hosts[0] != "es1:9200" {
+		t.Errorf("got %q", c.Clusters[0].Hosts[0])
+	}
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "clusters[0].hosts[1]:") {
+		t.Errorf("got errors %v", errs)
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want func(c *Config) any
+		val  any
+		err  string
+	}{
+		{"string", map[string]string{"EXTRACTOR_APP_PORT": "9500"},
+			func(c *Config) any { return c.App.Port }, "9500", ""},
+		{"pointer", map[string]string{"EXTRACTOR_APP_TIMEOUT": "45"},
+			func(c *Config) any { return *c.App.TimeOutRaw }, 45, ""},
+		{"nested", map[string]string{"EXTRACTOR_APP_TLS_MIN_VERSION": "1.3"},
+			func(c *Config) any { return c.App.TLS.MinVersion }, "1.3", ""},
+		{"cluster by position", map[string]string{"EXTRACTOR_CLUSTERS_1_PASSWORD": "secret"},
+			func(c *Config) any { return c.Clusters[1].Password }, "secret", ""},
+		{"list", map[string]string{"EXTRACTOR_CLUSTERS_0_HOSTS": "a:9200, b:9200"},
+			func(c *Config) any { return c.Clusters[0].Hosts }, []string{"a:9200", "b:9200"}, ""},
+		{"bool", map[string]string{"EXTRACTOR_CLUSTERS_0_SNIFF": "true"},
+			func(c *Config) any { return c.Clusters[0].Sniff }, true, ""},
+		{"bad int", map[string]string{"EXTRACTOR_APP_READY_CACHE": "ten"},
+			nil, nil, "EXTRACTOR_APP_READY_CACHE: "},
+		{"bad bool", map[string]string{"EXTRACTOR_CLUSTERS_0_SSL": "maybe"},
+			nil, nil, "EXTRACTOR_CLUSTERS_0_SSL: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c := Config{Clusters: []Cluster{{Name: "a"}, {Name: "b"}}}
+			err := applyEnvOverrides(&c)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.want(&c); !reflect.DeepEqual(got, tt.val) {
+				t.Errorf("got %#v, want %#v", got, tt.val)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// validator collects every problem instead of stopping at the first one,
+// so a single -check run shows everything that has to be fixed
+type validator struct {
+	errs []error
+}
+
+func (v *validator) add(path, format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) file(path, name string) {
+	if name == "" {
+		return
+	}
+	if _, err := os.Stat(name); err != nil {
+		v.add(path, "%s", err)
+	}
+}
+
+func (v *validator) positive(path string, n int64) {
+	if n <= 0 {
+		v.add(path, "must be greater than 0, got %d", n)
+	}
+}
+
+// clusterPath names a cluster in error messages the way it is written in main.yml
+func clusterPath(legacy bool, i int) string {
+	if legacy {
+		return []string{"snapshot", "search"}[i]
+	}
+	return fmt.Sprintf("clusters[%d]", i)
+}
+
+func (c *Config) validate(legacy bool) []error {
+	v := &validator{}
+
+	if p, err := strconv.Atoi(c.App.Port); err != nil || p < 1 || p > 65535 {
+		v.add("app.port", "must be a number between 1 and 65535, got %q", c.App.Port)
+	}
+	v.positive("app.timeout", int64(c.App.TimeOut))
+	v.positive("app.shutdown_timeout", int64(c.App.ShutdownTimeout))
+	v.positive("app.ready_cache", int64(c.App.ReadyCache))
+	v.positive("app.ready_timeout", int64(c.App.ReadyTimeout))
+	v.positive("app.reload_interval", int64(c.App.ReloadInterval))
+	v.positive("app.snapshot_cache_ttl", int64(c.App.SnapshotCache))
+
+	t := c.App.TLS
+	if (t.Cert == "") != (t.Key == "") {
+		v.add("app.tls", "cert and key must be set together")
+	}
+	v.file("app.tls.cert", t.Cert)
+	v.file("app.tls.key", t.Key)
+	v.file("app.tls.client_ca", t.ClientCA)
+	switch t.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		v.add("app.tls.min_version", "must be one of 1.0, 1.1, 1.2, 1.3, got %q", t.MinVersion)
+	}
+	switch t.ClientAuth {
+	case "", "require", "optional":
+	default:
+		v.add("app.tls.client_auth", "must be require or optional, got %q", t.ClientAuth)
+	}
+	if t.ClientAuth != "" && t.ClientCA == "" {
+		v.add("app.tls.client_auth", "requires client_ca")
+	}
+	if t.ClientCA != "" && t.Cert == "" {
+		v.add("app.tls.client_ca", "requires cert and key, client certificates are only checked over HTTPS")
+	}
+
+	names := make(map[string]string)
+	for i := range c.Clusters {
+		cl := &c.Clusters[i]
+		path := clusterPath(legacy, i)
+
+		for j, h := range cl.Hosts {
+			u, err := url.Parse(h)
+			if err != nil {
+				v.add(fmt.Sprintf("%s.hosts[%d]", path, j), "%s", err)
+				continue
+			}
+			if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				v.add(fmt.Sprintf("%s.hosts[%d]", path, j), "%q is not an http(s)://host:port URL", h)
+			}
+		}
+		if cl.Name == "" {
+			v.add(path, "cannot derive name from host %q, set name explicitly", cl.Host)
+		} else if prev, ok := names[cl.Name]; ok {
+			v.add(path+".name", "%q is already used by %s", cl.Name, prev)
+		} else {
+			names[cl.Name] = path
+		}
+		for _, r := range cl.Roles {
+			if r != RoleRestore && r != RoleSearch {
+				v.add(path+".roles", "unknown role %q, must be %s or %s", r, RoleRestore, RoleSearch)
+			}
+		}
+
+		v.file(path+".ca_cert", cl.CAcert)
+		v.file(path+".client_cert", cl.ClientCert)
+		v.file(path+".client_key", cl.ClientKey)
+		if (cl.ClientCert == "") != (cl.ClientKey == "") {
+			v.add(path, "client_cert and client_key must be set together")
+		}
+		// не ошибка: так бывает при временном отключении проверки сертификата
+		if cl.InsecureSkipVerify && cl.CAcert != "" {
+			log.Printf("Config: %s: ca_cert is ignored when insecure is set\n", path)
+		}
+
+		v.positive(path+".request_batch", cl.RequestBatch)
+		v.positive(path+".file_limit.rows", int64(cl.FileLimit.Rows))
+		v.positive(path+".file_limit.size", cl.FileLimit.Size)
+		v.positive(path+".sniff_interval", int64(cl.SniffInterval))
+		v.positive(path+".dead_timeout", int64(cl.DeadTimeout))
+		v.positive(path+".stale_after", int64(cl.StaleAfter))
+		v.positive(path+".retry.max_attempts", int64(cl.Retry.MaxAttempts))
+		v.positive(path+".retry.backoff", int64(cl.Retry.Backoff))
+		if cl.Retry.MaxBackoff < cl.Retry.Backoff {
+			v.add(path+".retry.max_backoff", "must not be less than backoff (%d)", cl.Retry.Backoff)
+		}
+		for _, s := range cl.Retry.Statuses {
+			if s < 100 || s > 599 {
+				v.add(path+".retry.statuses", "%d is not an HTTP status", s)
+			}
+		}
+
+		for j, sp := range cl.SnapshotPatterns {
+			p := fmt.Sprintf("%s.snapshot_patterns[%d]", path, j)
+			re, err := regexp.Compile(sp.Regex)
+			if err != nil {
+				v.add(p+".regex", "%s", err)
+			} else if re.NumSubexp() == 0 {
+				v.add(p+".regex", "has no capture group for the date")
+			}
+			if sp.Layout == "" {
+				v.add(p+".layout", "is empty")
+			}
+		}
+
+		t := cl.Transport
+		v.positive(path+".transport.connect_timeout", int64(t.ConnectTimeout))
+		v.positive(path+".transport.tls_handshake_timeout", int64(t.TLSHandshakeTimeout))
+		v.positive(path+".transport.response_header_timeout", int64(t.ResponseHeaderTimeout))
+		v.positive(path+".transport.request_timeout", int64(t.RequestTimeout))
+		v.positive(path+".transport.export_timeout", int64(t.ExportTimeout))
+		v.positive(path+".transport.max_idle_conns", int64(t.MaxIdleConns))
+		v.positive(path+".transport.max_idle_conns_per_host", int64(t.MaxIdleConnsPerHost))
+		v.positive(path+".transport.idle_conn_timeout", int64(t.IdleConnTimeout))
+		if t.MaxConnsPerHost < 0 {
+			v.add(path+".transport.max_conns_per_host", "must not be negative")
+		}
+		if t.Proxy != "" && t.Proxy != "env" {
+			if u, err := url.Parse(t.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+				v.add(path+".transport.proxy", "%q is not a proxy URL or env", t.Proxy)
+			}
+		}
+
+		if cl.SigV4.Enabled {
+			if cl.SigV4.Region == "" {
+				v.add(path+".sigv4.region", "is not set and AWS_REGION is empty")
+			}
+			if cl.SigV4.Service != "es" && cl.SigV4.Service != "aoss" {
+				v.add(path+".sigv4.service", "must be es or aoss, got %q", cl.SigV4.Service)
+			}
+			if (cl.SigV4.AccessKey == "") != (cl.SigV4.SecretKey == "") {
+				v.add(path+".sigv4", "access_key and secret_key must be set together")
+			}
+		}
+	}
+
+	if c.Audit.MaxSize < 0 {
+		v.add("audit.max_size", "must not be negative")
+	}
+	if c.Audit.MaxBackups < 0 {
+		v.add("audit.max_backups", "must not be negative")
+	}
+	if c.Audit.MaxBackups > 0 && !c.Audit.DeleteRotated {
+		v.add("audit.max_backups", "deletes old audit files, set audit.delete_rotated: true to allow it")
+	}
+	if c.Audit.UserHeader != "" && len(c.Audit.TrustedProxies) == 0 {
+		v.add("audit.user_header", "requires audit.trusted_proxies")
+	}
+	for _, p := range c.Audit.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			v.add("audit.trusted_proxies", "%q is not an IP address or CIDR", p)
+		}
+	}
+	if c.Audit.Index != "" {
+		if _, ok := names[c.Audit.Cluster]; !ok {
+			v.add("audit.cluster", "unknown cluster %q", c.Audit.Cluster)
+		}
+	}
+	v.positive("catalog.interval", int64(c.Catalog.Interval))
+	if c.Catalog.Path != "" {
+		if fi, err := os.Stat(filepath.Dir(c.Catalog.Path)); err != nil || !fi.IsDir() {
+			v.add("catalog.path", "directory %s does not exist", filepath.Dir(c.Catalog.Path))
+		}
+	}
+
+	return v.errs
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseString(t *testing.T, yml string) (Config, error) {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "main.yml")
+	if err := os.WriteFile(f, []byte(yml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Parse(f)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		yml  string
+		errs []string // пусто - конфиг корректен
+	}{
+		{"legacy", `
+snapshot:
+  host: http://es1:9200/
+search:
+  host: http://es2:9200/
+`, nil},
+		{"clusters", `
+clusters:
+  - name: logs
+    hosts: [http://es1:9200/, https://es2:9200/]
+    roles: [restore, search]
+`, nil},
+		{"bad port", `
+app:
+  port: "99999"
+clusters:
+  - name: logs
+    host: http://es1:9200/
+`, []string{`app.port: must be a number between 1 and 65535, got "99999"`}},
+		{"negative timeout", `
+app:
+  timeout: -1
+clusters:
+  - name: logs
+    host: http://es1:9200/
+`, []string{
+			"app.timeout: must be greater than 0, got -1",
+			// таймауты кластера по умолчанию берутся из app.timeout
+			"clusters[0].transport.connect_timeout: must be greater than 0, got -1",
+			"clusters[0].transport.response_header_timeout: must be greater than 0, got -1",
+			"clusters[0].transport.request_timeout: must be greater than 0, got -1",
+		}},
+		{"tls", `
+app:
+  tls:
+    cert: /nonexistent/cert.pem
+    min_version: "1.4"
+    client_auth: always
+clusters:
+  - name: logs
+    host: http://es1:9200/
+`, []string{
+			"app.tls: cert and key must be set together",
+			"app.tls.cert: stat /nonexistent/cert.pem",
+			`app.tls.min_version: must be one of 1.0, 1.1, 1.2, 1.3, got "1.4"`,
+			`app.tls.client_auth: must be require or optional, got "always"`,
+			"app.tls.client_auth: requires client_ca",
+		}},
+		{"bad clusters", `
+clusters:
+  - name: logs
+    hosts: [es1:9200]
+    roles: [backup]
+  - name: logs
+    host: http://es2:9200/
+`, []string{
+			`clusters[0].hosts[0]: "es1:9200/" is not an http(s)://host:port URL`,
+			`clusters[0].roles: unknown role "backup", must be restore or search`,
+			`clusters[1].name: "logs" is already used by clusters[0]`,
+		}},
+		{"retry", `
+clusters:
+  - name: logs
+    host: http://es1:9200/
+    retry:
+      backoff: 500
+      max_backoff: 100
+      statuses: [503, 42]
+`, []string{
+			"clusters[0].retry.max_backoff: must not be less than backoff (500)",
+			"clusters[0].retry.statuses: 42 is not an HTTP status",
+		}},
+		{"snapshot patterns", `
+clusters:
+  - name: logs
+    host: http://es1:9200/
+    snapshot_patterns:
+      - name: daily
+        regex: "^snap-\\d+$"
+`, []string{
+			"clusters[0].snapshot_patterns[0].regex: has no capture group for the date",
+			"clusters[0].snapshot_patterns[0].layout: is empty",
+		}},
+		{"sigv4", `
+clusters:
+  - name: logs
+    host: https://search.eu-west-1.es.amazonaws.com
+    sigv4:
+      enabled: true
+      region: eu-west-1
+      service: s3
+      access_key: AKID
+`, []string{
+			`clusters[0].sigv4.service: must be es or aoss, got "s3"`,
+			"clusters[0].sigv4: access_key and secret_key must be set together",
+		}},
+		{"insecure with ca_cert", `
+clusters:
+  - name: logs
+    host: https://es1:9200/
+    insecure: true
+    ca_cert: /nonexistent/ca.pem
+`, []string{"clusters[0].ca_cert: stat /nonexistent/ca.pem"}},
+		{"audit", `
+clusters:
+  - name: logs
+    host: http://es1:9200/
+audit:
+  user_header: X-Forwarded-User
+  trusted_proxies: [10.0.0.0/8, proxy.local]
+`, []string{`audit.trusted_proxies: "proxy.local" is not an IP address or CIDR`}},
+		{"audit backups", `
+clusters:
+  - name: logs
+    host: http://es1:9200/
+audit:
+  file: /var/log/extractor/audit.jsonl
+  max_backups: 10
+`, []string{"audit.max_backups: deletes old audit files, set audit.delete_rotated: true to allow it"}},
+		{"audit backups deleted", `
+clusters:
+  - name: logs
+    host: http://es1:9200/
+audit:
+  file: /var/log/extractor/audit.jsonl
+  max_backups: 10
+  delete_rotated: true
+`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseString(t, tt.yml)
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("no error, want %q", tt.errs)
+			}
+			got := strings.Split(err.Error(), "\n")
+			if len(got) != len(tt.errs) {
+				t.Fatalf("got %d errors, want %d:\n%s", len(got), len(tt.errs), err)
+			}
+			for i, want := range tt.errs {
+				if !strings.HasPrefix(got[i], want) {
+					t.Errorf("error %d: got %q, want %q", i, got[i], want)
+				}
+			}
+		})
+	}
+}
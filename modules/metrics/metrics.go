@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"io/fs"
+	"net/http"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "extractor"
+
+var DataDir = "/tmp/data"
+
+var (
+	APIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "API requests by action and response status.",
+	}, []string{"action", "status"})
+
+	APIDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "API request duration by action and response status.",
+		Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{"action", "status"})
+
+	ESRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "es_request_duration_seconds",
+		Help:      "Outbound Elasticsearch request duration by cluster, endpoint, method and response status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"cluster", "endpoint", "method", "status"})
+
+	ESRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "es_retries_total",
+		Help:      "Retried Elasticsearch requests by cluster, endpoint and reason.",
+	}, []string{"cluster", "endpoint", "reason"})
+
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Configuration reloads by result (success, failure).",
+	}, []string{"result"})
+
+	RestoresStarted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "restores_started_total",
+		Help:      "Restore requests accepted by the snapshot cluster.",
+	})
+
+	RestoresFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "restores_failed_total",
+		Help:      "Restore requests rejected by the snapshot cluster.",
+	})
+
+	ExportRows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "export_rows_total",
+		Help:      "Rows written to export files by format.",
+	}, []string{"format"})
+
+	ExportBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "export_bytes_total",
+		Help:      "Bytes written to export files by format.",
+	}, []string{"format"})
+
+	ExportDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "export_duration_seconds",
+		Help:      "Export duration by format.",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"format"})
+
+	CleanupDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanup_deleted_files_total",
+		Help:      "Export files removed by the cleanup loop.",
+	})
+
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "data_dir_bytes",
+		Help:      "Current size of the export directory.",
+	}, dataDirSize)
+)
+
+func dataDirSize() float64 {
+	var size int64
+	_ = filepath.WalkDir(DataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return float64(size)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
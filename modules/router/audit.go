@@ -0,0 +1,257 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/audit"
+	"github.com/flant/elasticsearch-extractor/modules/config"
+	"github.com/uzhinskiy/lib.go/helpers"
+)
+
+// Действия, которые попадают в журнал аудита
+var auditedActions = map[string]bool{
+	"restore":       true,
+	"restore_range": true,
+	"del_index":     true,
+	"search":        true,
+	"prepare_csv":   true,
+	"prepare_json":  true,
+}
+
+// Действия со снапшотами выполняются на кластере с ролью restore (values.cluster),
+// поисковые - на кластере с ролью search (search.cluster)
+var restoreActions = map[string]bool{
+	"get_repositories":     true,
+	"get_repository":       true,
+	"get_nodes":            true,
+	"get_indices":          true,
+	"del_index":            true,
+	"get_snapshots":        true,
+	"get_snapshots_sorted": true,
+	"get_snapshot":         true,
+	"restore":              true,
+	"restore_range":        true,
+	"restore_report":       true,
+}
+
+var searchActions = map[string]bool{
+	"get_index_groups": true,
+	"get_mapping":      true,
+	"search":           true,
+	"prepare_csv":      true,
+	"prepare_json":     true,
+}
+
+// actionLabel keeps the action label of the API metrics bounded: an action the API
+// does not know is counted as "unknown"
+func actionLabel(action string) string {
+	if restoreActions[action] || searchActions[action] || action == "find_index" || action == "get_clusters" {
+		return action
+	}
+	return "unknown"
+}
+
+// statusWriter remembers the response status and the error text sent by http.Error
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	errmsg string
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if sw.status >= 400 && sw.errmsg == "" {
+		sw.errmsg = strings.TrimSpace(string(b))
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// esAuditSink stores audit events in an Elasticsearch index through the regular cluster clients.
+// Events are queued and sent in the background, so a slow cluster does not hold up the requests;
+// when the queue is full the event is dropped with an error in the log.
+type esAuditSink struct {
+	rt      *Router
+	index   string
+	cluster string
+
+	sync.Mutex
+	queue  chan audit.Event
+	closed bool
+	done   chan struct{}
+}
+
+const (
+	auditQueueSize    = 1000
+	auditFlushTimeout = 10 * time.Second
+)
+
+func newESAuditSink(rt *Router, index, cluster string) *esAuditSink {
+	s := &esAuditSink{rt: rt, index: index, cluster: cluster, queue: make(chan audit.Event, auditQueueSize), done: make(chan struct{})}
+	go s.run()
+	return s
+}
+
+func (s *esAuditSink) run() {
+	defer close(s.done)
+	for e := range s.queue {
+		if err := s.post(e); err != nil {
+			log.Println("audit:", err)
+		}
+	}
+}
+
+func (s *esAuditSink) post(e audit.Event) error {
+	var doc map[string]interface{}
+	j, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(j, &doc)
+	if err != nil {
+		return err
+	}
+	_, err = s.rt.doPost(s.index+"/_doc", doc, s.cluster)
+	return err
+}
+
+func (s *esAuditSink) Write(e audit.Event) error {
+	s.Lock()
+	defer s.Unlock()
+	// событие, пришедшее после Close (например, во время перезагрузки конфига), отправляем сразу
+	if s.closed {
+		return s.post(e)
+	}
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		return fmt.Errorf("index %s: queue is full, %s event dropped", s.index, e.Action)
+	}
+}
+
+// Close sends the queued events, waiting for them at most auditFlushTimeout
+func (s *esAuditSink) Close() error {
+	s.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(auditFlushTimeout):
+		return fmt.Errorf("index %s: %d events not sent", s.index, len(s.queue))
+	}
+}
+
+func (rt *Router) auditPrepare() {
+	al, err := rt.newAuditLogger(rt.conf)
+	if err != nil {
+		log.Fatalf("cannot open audit file: %s\n", err)
+	}
+	rt.al = al
+}
+
+func (rt *Router) newAuditLogger(conf config.Config) (*audit.Logger, error) {
+	var sinks []audit.Sink
+	if conf.Audit.File != "" {
+		fs, err := audit.NewFileSink(conf.Audit.File, conf.Audit.MaxSize, conf.Audit.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, fs)
+	}
+	if conf.Audit.Index != "" {
+		sinks = append(sinks, newESAuditSink(rt, conf.Audit.Index, conf.Audit.Cluster))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return audit.New(sinks...), nil
+}
+
+// requestUser returns the identity of the user: the verified client certificate subject,
+// the BasicAuth user or the name passed by one of the trusted authenticating proxies
+func (rt *Router) requestUser(r *http.Request) string {
+	if u := clientCertUser(r); u != "" {
+		return u
+	}
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		return u
+	}
+	conf := rt.config().Audit
+	if conf.UserHeader != "" && trustedProxy(r.RemoteAddr, conf.TrustedProxies) {
+		if u := r.Header.Get(conf.UserHeader); u != "" {
+			return u
+		}
+	}
+	return "-"
+}
+
+// trustedProxy reports whether the direct peer of the connection is one of the proxies
+func trustedProxy(remoteAddr string, proxies []string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, p := range proxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the peer; the X-Real-IP and X-Forwarded-For headers are
+// taken only from the trusted proxies, like the user header
+func clientIP(r *http.Request, proxies []string) string {
+	if trustedProxy(r.RemoteAddr, proxies) {
+		return helpers.GetIP(r.RemoteAddr, r.Header.Get("X-Real-IP"), r.Header.Get("X-Forwarded-For"))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (rt *Router) auditRecord(r *http.Request, sw *statusWriter, e *audit.Event) {
+	e.User = rt.requestUser(r)
+	e.IP = clientIP(r, rt.config().Audit.TrustedProxies)
+	e.Status = sw.status
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	if e.Status < 400 {
+		e.Outcome = "success"
+	} else {
+		e.Outcome = "failure"
+		e.Error = sw.errmsg
+	}
+	rt.auditLogger().Record(*e)
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxy(t *testing.T) {
+	proxies := []string{"10.0.0.5", "192.168.0.0/16", "::1"}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.5:41000", true},
+		{"10.0.0.6:41000", false},
+		{"192.168.7.1:80", true},
+		{"[::1]:8080", true},
+		{"10.0.0.5", true},
+		{"proxy.local:80", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := trustedProxy(tt.addr, proxies); got != tt.want {
+			t.Errorf("trustedProxy(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if trustedProxy("10.0.0.5:41000", nil) {
+		t.Error("trusted without proxies")
+	}
+}
+
+func TestRequestUser(t *testing.T) {
+	rt := &Router{}
+	rt.conf.Audit.UserHeader = "X-Forwarded-User"
+	rt.conf.Audit.TrustedProxies = []string{"10.0.0.5"}
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "cert-user"}}
+	tests := []struct {
+		name   string
+		remote string
+		cert   bool
+		basic  string
+		header string
+		want   string
+	}{
+		{"certificate first", "10.0.0.5:1", true, "basic-user", "proxy-user", "cert-user"},
+		{"basic before header", "10.0.0.5:1", false, "basic-user", "proxy-user", "basic-user"},
+		{"header from proxy", "10.0.0.5:1", false, "", "proxy-user", "proxy-user"},
+		{"header from client", "10.0.0.9:1", false, "", "proxy-user", "-"},
+		{"nobody", "10.0.0.5:1", false, "", "", "-"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.cert {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		}
+		if tt.basic != "" {
+			r.SetBasicAuth(tt.basic, "secret")
+		}
+		if tt.header != "" {
+			r.Header.Set("X-Forwarded-User", tt.header)
+		}
+		if got := rt.requestUser(r); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote string
+		realIP string
+		xff    string
+		want   string
+	}{
+		{"direct", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"spoofed header", "203.0.113.7:5000", "1.2.3.4", "5.6.7.8", "203.0.113.7"},
+		{"real ip from proxy", "10.0.0.5:5000", "198.51.100.1", "5.6.7.8", "198.51.100.1"},
+		{"forwarded from proxy", "10.0.0.5:5000", "", "198.51.100.2", "198.51.100.2"},
+		{"proxy without headers", "10.0.0.5:5000", "", "", "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := clientIP(r, []string{"10.0.0.5"}); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package router
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/catalog"
+	"github.com/flant/elasticsearch-extractor/modules/config"
+)
+
+// catalogSource reads the snapshots for the catalog through the regular cluster clients
+type catalogSource struct {
+	rt *Router
+}
+
+func (s catalogSource) Repositories(cluster string) ([]string, error) {
+	return s.rt.repositories(cluster)
+}
+
+// repositories returns the names of the snapshot repositories of the cluster
+func (rt *Router) repositories(cluster string) ([]string, error) {
+	response, err := rt.doGet("_snapshot?format=json", cluster)
+	if err != nil {
+		return nil, err
+	}
+	var repos map[string]json.RawMessage
+	if err := json.Unmarshal(response, &repos); err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s catalogSource) Snapshots(cluster, repo string) ([]catalog.Snapshot, error) {
+	c, err := s.rt.cl.get(cluster, config.RoleRestore)
+	if err != nil {
+		return nil, err
+	}
+	snaps, err := s.rt.fetchSnapshots(c, repo, "*")
+	if err != nil {
+		return nil, err
+	}
+	var res []catalog.Snapshot
+	for _, n := range snaps {
+		// незавершенный снапшот еще меняется
+		if n.State == "IN_PROGRESS" {
+			continue
+		}
+		cs := catalog.Snapshot{
+			Name:             n.Snapshot,
+			Uuid:             n.Uuid,
+			State:            n.State,
+			StartTime:        n.StartTimeInMillis,
+			EndTime:          n.EndTimeInMillis,
+			Duration:         n.DurationInMillis,
+			ShardsTotal:      n.Shards.Total,
+			ShardsSuccessful: n.Shards.Successful,
+			ShardsFailed:     n.Shards.Failed,
+			Failures:         len(n.Failures),
+			Details:          n.IndexDetails != nil,
+		}
+		for _, idx := range n.Indices {
+			d := n.IndexDetails[idx]
+			cs.Indices = append(cs.Indices, catalog.Index{Name: idx, Size: d.SizeInBytes, Shards: d.ShardCount})
+		}
+		res = append(res, cs)
+	}
+	return res, nil
+}
+
+func (s catalogSource) Indices(cluster, repo, snapshot string) ([]catalog.Index, error) {
+	response, err := s.rt.doGet("_snapshot/"+repo+"/"+snapshot+"/_status", cluster)
+	if err != nil {
+		return nil, err
+	}
+	var status snapStatus
+	if err := json.Unmarshal(response, &status); err != nil {
+		return nil, err
+	}
+	var res []catalog.Index
+	for _, sn := range status.Snapshots {
+		for name, idx := range sn.Indices {
+			res = append(res, catalog.Index{Name: name, Size: int64(idx.Stats.Total.Size), Shards: idx.ShardsStats.Total})
+		}
+	}
+	return res, nil
+}
+
+// catalogItem converts a catalog entry into the snapshot list entry, like snapshotItem
+func (c *esCluster) catalogItem(s catalog.Snapshot) snapItem {
+	item := snapItem{
+		Snapshot:    s.Name,
+		Uuid:        s.Uuid,
+		State:       s.State,
+		StartTime:   s.StartTime,
+		EndTime:     s.EndTime,
+		Duration:    s.Duration,
+		IndexCount:  len(s.Indices),
+		ShardsTotal: s.ShardsTotal,
+		ShardsOK:    s.ShardsSuccessful,
+		ShardsFail:  s.ShardsFailed,
+		Failures:    s.Failures,
+	}
+	for _, idx := range s.Indices {
+		item.Size += idx.Size
+	}
+	start := time.UnixMilli(s.StartTime).UTC()
+	item.CreateEpoch = start.Unix()
+	item.CreateDate = start.Format("2006.01.02")
+	if d, ok := c.snapshotDate(s.Name); ok {
+		item.DataDate = d.Format("2006.01.02")
+	}
+	return item
+}
+
+// catalogSnapshots returns the snapshot list of the repository from the catalog
+// and the time the repository was read. The snapshots the catalog does not have yet,
+// still in progress or taken since the last refresh, are added from the cluster.
+func (rt *Router) catalogSnapshots(c *esCluster, repo string) ([]snapItem, time.Time, bool) {
+	snaps, refreshed, ok := rt.catalog.Snapshots(c.conf.Name, repo)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	items := make([]snapItem, 0, len(snaps))
+	known := make(map[string]bool)
+	for _, s := range snaps {
+		items = append(items, c.catalogItem(s))
+		known[s.Name] = true
+	}
+
+	var live []snapItem
+	var err error
+	if c.supports(featureSnapshotFromSort) == nil {
+		var newest []esSnapshot
+		newest, err = rt.newestSnapshots(c, repo, snaps)
+		for _, n := range newest {
+			live = append(live, c.snapshotItem(n))
+		}
+	} else {
+		live, err = rt.cachedSnapshots(c, repo, false)
+	}
+	if err != nil {
+		log.Printf("Cluster %s: cannot list the newest snapshots of %s: %s\n", c.conf.Name, repo, err)
+	}
+	for _, item := range live {
+		if !known[item.Snapshot] {
+			items = append(items, item)
+		}
+	}
+	return items, refreshed, true
+}
+
+// newestSnapshots lists the snapshots that started since the newest one of the catalog
+// (snaps sorted by start time), so only the part the catalog can miss is read
+func (rt *Router) newestSnapshots(c *esCluster, repo string, snaps []catalog.Snapshot) ([]esSnapshot, error) {
+	path := "_snapshot/" + repo + "/*?format=json&sort=start_time"
+	if len(snaps) > 0 {
+		path += "&from_sort_value=" + strconv.FormatInt(snaps[len(snaps)-1].StartTime, 10)
+	}
+	if c.supports(featureSnapshotIndexDetails) == nil {
+		path += "&index_details=true"
+	}
+	response, err := rt.doGet(path, c.conf.Name)
+	if err != nil {
+		return nil, err
+	}
+	snap_resp, err := decodeSnapshots(response)
+	if err != nil {
+		return nil, err
+	}
+	var res []esSnapshot
+	for _, n := range snap_resp.Snapshots {
+		if !c.hiddenSnapshot(n.Snapshot) {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+// refreshCatalog updates the catalog with the snapshots of all restore clusters
+func (rt *Router) refreshCatalog() {
+	var clusters []string
+	for _, c := range rt.cl.all() {
+		if c.conf.CanRestore() {
+			clusters = append(clusters, c.conf.Name)
+		}
+	}
+	start := time.Now()
+	if err := rt.catalog.Refresh(clusters); err != nil {
+		log.Printf("Catalog: %s\n", err)
+	}
+	log.Printf("Catalog: %d snapshots, refreshed in %s\n", rt.catalog.Len(), time.Since(start).Round(time.Millisecond))
+}
+
+func (rt *Router) catalogLoop() {
+	for {
+		rt.refreshCatalog()
+		select {
+		case <-rt.ctx.Done():
+			return
+		case <-time.After(time.Duration(rt.config().Catalog.Interval) * time.Second):
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package router
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/config"
+	"github.com/flant/elasticsearch-extractor/modules/sigv4"
+)
+
+// esCluster is one configured Elasticsearch cluster with its own client and disk usage stats
+type esCluster struct {
+	conf   config.Cluster
+	client *http.Client
+	// scroll-запросы экспорта идут без response_header_timeout, их ограничивает export_timeout
+	exportClient *http.Client
+	pool         *nodePool
+	signer       *sigv4.Signer
+	done         chan struct{}
+	// шаблоны имен снапшотов для извлечения даты
+	snapPatterns []snapPattern
+
+	sync.RWMutex
+	nodes nodesArray
+	info  clusterInfo
+}
+
+// clusterRegistry holds the clusters in configuration order and finds them by name
+type clusterRegistry struct {
+	sync.RWMutex
+	list   []*esCluster
+	byName map[string]*esCluster
+}
+
+func newCluster(cc config.Cluster) (*esCluster, error) {
+	tlsClientConfig, err := createTLSConfig(cc.CAcert, cc.ClientCert, cc.ClientKey, cc.InsecureSkipVerify)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %s", cc.Name, err)
+	}
+	netTransport, err := newTransport(cc.Transport, tlsClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %s", cc.Name, err)
+	}
+	exportTransport := netTransport.Clone()
+	exportTransport.ResponseHeaderTimeout = 0
+	// общий таймаут задается на каждый запрос в perform: у экспорта он длиннее
+	c := &esCluster{
+		conf:         cc,
+		done:         make(chan struct{}),
+		pool:         newNodePool(cc.Name, cc.Hosts, time.Duration(cc.DeadTimeout)*time.Second),
+		client:       &http.Client{Transport: netTransport},
+		exportClient: &http.Client{Transport: exportTransport},
+	}
+	c.snapPatterns, err = compileSnapPatterns(cc.SnapshotPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %s", cc.Name, err)
+	}
+	if cc.SigV4.Enabled {
+		signer, err := newSigner(cc.SigV4)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %s", cc.Name, err)
+		}
+		c.signer = signer
+	}
+	return c, nil
+}
+
+func newTransport(t config.Transport, tlsClientConfig *tls.Config) (*http.Transport, error) {
+	sec := func(n int) time.Duration { return time.Duration(n) * time.Second }
+	tr := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   sec(t.ConnectTimeout),
+			KeepAlive: sec(t.KeepAlive),
+		}).DialContext,
+		TLSClientConfig:       tlsClientConfig,
+		TLSHandshakeTimeout:   sec(t.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: sec(t.ResponseHeaderTimeout),
+		MaxIdleConns:          t.MaxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		IdleConnTimeout:       sec(t.IdleConnTimeout),
+		DisableKeepAlives:     t.DisableKeepAlives,
+	}
+	switch t.Proxy {
+	case "":
+	case "env":
+		tr.Proxy = http.ProxyFromEnvironment
+	default:
+		u, err := url.Parse(t.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	return tr, nil
+}
+
+// isExport reports whether the request is a scroll request of an export
+func isExport(path string) bool {
+	return strings.Contains(path, "scroll")
+}
+
+// timeout is the overall deadline of a request: scroll requests of exports get export_timeout
+func (c *esCluster) timeout(path string) time.Duration {
+	if isExport(path) {
+		return time.Duration(c.conf.Transport.ExportTimeout) * time.Second
+	}
+	return time.Duration(c.conf.Transport.RequestTimeout) * time.Second
+}
+
+// httpClient returns the client for the request: the export one has no response header
+// timeout, so a long scroll request is limited only by export_timeout
+func (c *esCluster) httpClient(path string) *http.Client {
+	if isExport(path) {
+		return c.exportClient
+	}
+	return c.client
+}
+
+// newSigner uses static credentials from the config if set, otherwise the environment
+// and the shared credentials file, read again every 5 minutes to follow key rotation
+func newSigner(sc config.SigV4) (*sigv4.Signer, error) {
+	if sc.Region == "" {
+		return nil, errors.New("sigv4: region is not set")
+	}
+	if sc.Service != "es" && sc.Service != "aoss" {
+		return nil, fmt.Errorf("sigv4: unknown service %q, must be es or aoss", sc.Service)
+	}
+	creds := sigv4.Credentials{AccessKey: sc.AccessKey, SecretKey: sc.SecretKey, SessionToken: sc.SessionToken}
+	if creds.AccessKey != "" {
+		return &sigv4.Signer{Region: sc.Region, Service: sc.Service, Credentials: creds}, nil
+	}
+	load := func() (sigv4.Credentials, error) { return sigv4.LoadCredentials(sc.Profile) }
+	creds, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &sigv4.Signer{Region: sc.Region, Service: sc.Service, Credentials: creds, Load: load, Interval: 5 * time.Minute}, nil
+}
+
+func newClusterRegistry(conf config.Config) (*clusterRegistry, error) {
+	cr := &clusterRegistry{byName: make(map[string]*esCluster)}
+	if _, _, err := cr.update(conf); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// update switches the registry to the clusters of conf. Clusters whose settings did not
+// change are kept with their clients and node state; the others are built anew. Nothing
+// is replaced if any cluster cannot be built. Returned are the new clusters, to be started,
+// and the replaced or removed ones, to be stopped.
+func (cr *clusterRegistry) update(conf config.Config) (started, stopped []*esCluster, err error) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	var list []*esCluster
+	byName := make(map[string]*esCluster)
+	for _, cc := range conf.Clusters {
+		if _, ok := byName[cc.Name]; ok {
+			return nil, nil, fmt.Errorf("duplicate cluster name %q", cc.Name)
+		}
+		c, ok := cr.byName[cc.Name]
+		if !ok || !reflect.DeepEqual(c.conf, cc) {
+			c, err = newCluster(cc)
+			if err != nil {
+				return nil, nil, err
+			}
+			started = append(started, c)
+		}
+		list = append(list, c)
+		byName[cc.Name] = c
+	}
+	if len(list) == 0 {
+		return nil, nil, errors.New("no clusters configured")
+	}
+
+	for name, c := range cr.byName {
+		if byName[name] != c {
+			stopped = append(stopped, c)
+		}
+	}
+	cr.list = list
+	cr.byName = byName
+	return started, stopped, nil
+}
+
+// stop ends the background work of a cluster that was replaced or removed; requests
+// already running with it are not interrupted
+func (c *esCluster) stop() {
+	close(c.done)
+}
+
+// get finds a cluster by name. "Snapshot" and "Search" are kept as aliases for the first
+// cluster with the restore or search role, so old clients keep working; an empty name
+// means the first cluster with the given role.
+func (cr *clusterRegistry) get(name string, role string) (*esCluster, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	switch name {
+	case "Snapshot":
+		role = config.RoleRestore
+		name = ""
+	case "Search":
+		role = config.RoleSearch
+		name = ""
+	}
+	if name == "" {
+		for _, c := range cr.list {
+			if role == "" || c.conf.HasRole(role) {
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("no cluster with role %s", role)
+	}
+	c, ok := cr.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q", name)
+	}
+	if role != "" && !c.conf.HasRole(role) {
+		return nil, fmt.Errorf("cluster %s has no %s role", name, role)
+	}
+	return c, nil
+}
+
+func (cr *clusterRegistry) all() []*esCluster {
+	cr.RLock()
+	defer cr.RUnlock()
+	return append([]*esCluster(nil), cr.list...)
+}
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	distElasticsearch = "elasticsearch"
+	distOpenSearch    = "opensearch"
+)
+
+// clusterInfo is what the root endpoint of the cluster reports about itself
+type clusterInfo struct {
+	Distribution string    `json:"distribution"`
+	Version      string    `json:"version"`
+	DetectedAt   time.Time `json:"detected_at"`
+	Error        string    `json:"error,omitempty"`
+	major, minor int
+}
+
+type rootResponse struct {
+	Version struct {
+		Number       string `json:"number"`
+		Distribution string `json:"distribution"`
+	} `json:"version"`
+}
+
+// feature is an API that exists only since some version; an empty version
+// means the distribution does not have it at all
+type feature struct {
+	name  string
+	es    string
+	os    string
+	usage string
+}
+
+var (
+	featureTrackTotalHits       = feature{"track_total_hits", "7.0", "1.0", "exact hit counts"}
+	featureDataStreams          = feature{"data_streams", "7.9", "1.0", "data streams in index groups"}
+	featureSnapshotPagination   = feature{"snapshot_pagination", "7.14", "", "server-side snapshot paging"}
+	featureSnapshotIndexDetails = feature{"snapshot_index_details", "7.13", "", "snapshot size"}
+	featureSnapshotFromSort     = feature{"snapshot_from_sort_value", "7.16", "", "listing only the newest snapshots"}
+	// пока только определяются и показываются в get_clusters
+	featurePIT   = feature{"point_in_time", "7.10", "2.4", "point in time search"}
+	featureMount = feature{"searchable_snapshots", "7.10", "", "mounting snapshots with _mount"}
+
+	features = []feature{featureTrackTotalHits, featureDataStreams, featureSnapshotPagination, featureSnapshotIndexDetails, featureSnapshotFromSort, featurePIT, featureMount}
+)
+
+func parseVersion(v string) (int, int) {
+	parts := strings.SplitN(v, ".", 3)
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) > 1 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor
+}
+
+// detect asks the root endpoint for the distribution and version of the cluster
+func (rt *Router) detect(c *esCluster) {
+	info := clusterInfo{DetectedAt: time.Now()}
+	response, err := rt.doGet("", c.conf.Name)
+	if err == nil {
+		var root rootResponse
+		err = json.Unmarshal(response, &root)
+		if err == nil && root.Version.Number == "" {
+			err = fmt.Errorf("no version in the root endpoint response")
+		}
+		info.Version = root.Version.Number
+		info.Distribution = distElasticsearch
+		if root.Version.Distribution == distOpenSearch {
+			info.Distribution = distOpenSearch
+		}
+		info.major, info.minor = parseVersion(info.Version)
+	}
+	if err != nil {
+		info.Error = err.Error()
+		log.Printf("Cluster %s: cannot detect version: %s\n", c.conf.Name, err)
+	} else {
+		log.Printf("Cluster %s: %s %s\n", c.conf.Name, info.Distribution, info.Version)
+	}
+
+	c.Lock()
+	// неудачная попытка не затирает уже известную версию
+	if err == nil || c.info.Version == "" {
+		c.info = info
+	}
+	c.Unlock()
+}
+
+func (c *esCluster) clusterInfo() clusterInfo {
+	c.RLock()
+	defer c.RUnlock()
+	return c.info
+}
+
+// supports returns an error explaining why the feature is not available on the cluster.
+// While the version is unknown (e.g. the user lacks the monitor privilege for the root
+// endpoint) no feature is used, so old clusters get only requests they understand.
+func (c *esCluster) supports(f feature) error {
+	info := c.clusterInfo()
+	if info.Version == "" {
+		return fmt.Errorf("%s is not used while the version of cluster %s is unknown", f.usage, c.conf.Name)
+	}
+	min := f.es
+	if info.Distribution == distOpenSearch {
+		min = f.os
+	}
+	if min == "" {
+		return fmt.Errorf("%s is not available in %s", f.usage, info.Distribution)
+	}
+	major, minor := parseVersion(min)
+	if info.major < major || (info.major == major && info.minor < minor) {
+		return fmt.Errorf("%s requires %s %s or newer, cluster %s runs %s", f.usage, info.Distribution, min, c.conf.Name, info.Version)
+	}
+	return nil
+}
+
+// supportedFeatures lists the names of the features available on the cluster
+func (c *esCluster) supportedFeatures() []string {
+	var l []string
+	for _, f := range features {
+		if c.supports(f) == nil {
+			l = append(l, f.name)
+		}
+	}
+	return l
+}
+
+// UnmarshalJSON accepts both hits.total shapes: a number (6.x and rest_total_hits_as_int)
+// and an object with value and relation (7.0+)
+func (t *HitsTotal) UnmarshalJSON(b []byte) error {
+	if n, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+		t.Value = n
+		return nil
+	}
+	var v struct {
+		Value int64 `json:"value"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	t.Value = v.Value
+	return nil
+}
+
+// decodeSnapshots reads the snapshot list in both shapes of GET _snapshot: the flat
+// snapshots array and the per-repository responses array of some 7.x releases
+func decodeSnapshots(b []byte) (snapResponse, error) {
+	var sr struct {
+		snapResponse
+		Responses []snapResponse `json:"responses"`
+	}
+	if err := json.Unmarshal(b, &sr); err != nil {
+		return snapResponse{}, err
+	}
+	res := sr.snapResponse
+	for _, r := range sr.Responses {
+		res.Snapshots = append(res.Snapshots, r.Snapshots...)
+	}
+	return res, nil
+}
@@ -0,0 +1,31 @@
+package router
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSupportedFeatures(t *testing.T) {
+	tests := []struct {
+		dist    string
+		version string
+		want    string
+	}{
+		{distElasticsearch, "6.8.23", ""},
+		{distElasticsearch, "7.9.3", "track_total_hits,data_streams"},
+		{distElasticsearch, "7.10.2", "track_total_hits,data_streams,point_in_time,searchable_snapshots"},
+		{distElasticsearch, "7.17.0", "track_total_hits,data_streams,snapshot_pagination,snapshot_index_details,snapshot_from_sort_value,point_in_time,searchable_snapshots"},
+		{distElasticsearch, "8.12.0", "track_total_hits,data_streams,snapshot_pagination,snapshot_index_details,snapshot_from_sort_value,point_in_time,searchable_snapshots"},
+		{distOpenSearch, "2.3.0", "track_total_hits,data_streams"},
+		{distOpenSearch, "2.4.0", "track_total_hits,data_streams,point_in_time"},
+		// версия неизвестна - ничего не используется
+		{distElasticsearch, "", ""},
+	}
+	for _, tt := range tests {
+		c := &esCluster{info: clusterInfo{Distribution: tt.dist, Version: tt.version}}
+		c.info.major, c.info.minor = parseVersion(tt.version)
+		if got := strings.Join(c.supportedFeatures(), ","); got != tt.want {
+			t.Errorf("%s %s: got %s, want %s", tt.dist, tt.version, got, tt.want)
+		}
+	}
+}
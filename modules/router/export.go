@@ -0,0 +1,214 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/audit"
+	"github.com/flant/elasticsearch-extractor/modules/config"
+)
+
+func writeCsvRow(f *os.File, row Hit, request apiRequest, fields_list []string) {
+	var data any
+	if len(request.Search.Fields) == 0 {
+		f.WriteString(fmt.Sprintf("%v;", row.Source[request.Search.Timefields[0]]))
+	} else {
+		f.WriteString(fmt.Sprintf("%v;", row.Fields[request.Search.Timefields[0]]))
+	}
+	for _, fm := range fields_list {
+		if len(request.Search.Fields) == 0 {
+			data = row.Source[fm]
+		} else {
+			data = row.Fields[fm]
+		}
+
+		if data == nil {
+			f.WriteString(fmt.Sprintf("%s;", "--"))
+		} else {
+			switch reflect.TypeOf(data).Kind() {
+			case reflect.Slice:
+				{
+					s := reflect.ValueOf(data)
+					var ss string
+					for i := 0; i < s.Len(); i++ {
+						ss = ss + fmt.Sprintf("%v, ", s.Index(i))
+					}
+					ss = strings.TrimSuffix(ss, ", ")
+					ss = strings.Replace(ss, "\n", "", -1)
+					ss = strings.Replace(ss, "\"", "\"\"", -1)
+					f.WriteString(fmt.Sprintf(`"%s";`, ss))
+				}
+			case reflect.String:
+				{
+					f.WriteString(fmt.Sprintf(`"%v";`, strings.Replace(strings.Replace(data.(string), "\n", "", -1), "\"", "\"\"", -1)))
+				}
+			default:
+				{
+					f.WriteString(fmt.Sprintf("%v;", data))
+				}
+			}
+		}
+	}
+	f.WriteString("\n")
+}
+
+func (rt *Router) saveHintsToCsvFile(request apiRequest, ev *audit.Event) (err error) {
+	var (
+		use_source     string
+		query          string
+		filters        string
+		must_not       string
+		xql            string
+		full_query     string
+		timefield      string
+		sort           string
+		tf             string
+		fields         string
+		req            map[string]interface{}
+		scrollresponse scrollResponse
+		fields_list    []string
+		request_batch  int64
+	)
+
+	if !rt.jobs.start() {
+		return errShuttingDown
+	}
+	defer rt.jobs.done()
+
+	c, err := rt.cl.get(request.Search.Cluster, config.RoleSearch)
+	if err != nil {
+		return err
+	}
+	request_batch = c.conf.RequestBatch
+
+	ds, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateStart+" (MSK)")
+	de, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateEnd+" (MSK)")
+
+	if len(request.Search.Fields) == 0 {
+		use_source = `"_source": true`
+		fields_list = request.Search.Mapping
+	} else {
+		use_source = `"_source": false`
+		fields_list = request.Search.Fields
+	}
+
+	for _, f := range request.Search.Filters {
+
+		if f.Operation == "is" {
+			filters += `{ "match_phrase": {"` + f.Field + `":"` + f.Value + `" } },`
+		} else if f.Operation == "exists" {
+			filters += `{ "exists": {"field":"` + f.Field + `" } },`
+		} else if f.Operation == "is_not" {
+			must_not += `{ "match_phrase": {"` + f.Field + `":"` + f.Value + `" } },`
+		} else if f.Operation == "does_not_exists" {
+			must_not += `{ "exists": {"field":"` + f.Field + `" } },`
+		}
+	}
+	filters += `{"match_all": {}}`
+	must_not, _ = strings.CutSuffix(must_not, ",")
+
+	if request.Search.Xql != "" {
+		xql = `{ "simple_query_string": { "query": "` + request.Search.Xql + `" } }`
+	}
+	if len(request.Search.Timefields) > 0 {
+		timefield = request.Search.Timefields[0]
+		fields = `"fields": ["` + timefield + `", "` + strings.Join(request.Search.Fields, "\", \"") + `" ]`
+		sort = `"sort": [ {"` + timefield + `": "desc" } ]`
+		tf = `{ "range": { "` + timefield + `": {
+						   "gte": "` + ds.Format("2006-01-02T15:04:05.000Z") + `",
+						   "lte": "` + de.Format("2006-01-02T15:04:05.000Z") + `",
+						   "format": "strict_date_optional_time" } } },`
+	} else {
+		sort = ""
+		tf = ""
+		fields = `"fields": ["` + strings.Join(request.Search.Fields, "\", \"") + `" ]`
+	}
+	query = fmt.Sprintf(`"query": { "bool": { "must": [ %s ],"filter": [  %s  %s ], "should": [],"must_not": [ %s ] }}`, xql, tf, filters, must_not)
+
+	full_query = fmt.Sprintf(`{"size": %d, %s, %s, %s, %s }`, request_batch, sort, use_source, fields, query)
+	ev.Query = full_query
+
+	err = json.Unmarshal([]byte(full_query), &req)
+	if err != nil {
+		return err
+	}
+	sresponse, err := rt.doPostCtx(rt.ctx, request.Search.Index+"/_search?scroll=10m", req, c.conf.Name)
+	if err != nil {
+		return err
+	}
+
+	filePath := "/tmp/data/" + request.Search.Fname + ".csv"
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if fi, err := f.Stat(); err == nil {
+			ev.Bytes = fi.Size()
+		}
+		f.Close()
+	}()
+	// прерванная по любой причине выгрузка не должна выглядеть завершенной
+	defer func() {
+		if err != nil {
+			markIncomplete(filePath)
+		}
+	}()
+
+	if len(request.Search.Timefields) > 0 {
+		f.WriteString(request.Search.Timefields[0] + `;` + strings.Join(fields_list, ";") + "\n")
+	} else {
+		f.WriteString(strings.Join(fields_list, ";") + "\n")
+	}
+
+	err = json.Unmarshal(sresponse, &scrollresponse)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		rt.clearScroll(c.conf.Name, scrollresponse.ScrollID)
+	}()
+
+	for i := 0; ; i++ {
+		for _, row := range scrollresponse.HitsRoot.Hits {
+			fileInfo, err := os.Stat(filePath)
+			if err != nil {
+				return err
+			}
+			if fileInfo.Size() > c.conf.FileLimit.Size {
+				return fmt.Errorf("file %s with size %d is too big", filePath, fileInfo.Size())
+			}
+			writeCsvRow(f, row, request, fields_list)
+			ev.Rows++
+		}
+
+		if scrollresponse.ScrollID == "" || len(scrollresponse.HitsRoot.Hits) == 0 || i >= c.conf.FileLimit.Rows/10000 {
+			break
+		}
+		if rt.stopping() {
+			log.Println("Export interrupted by shutdown:", filePath)
+			return errInterrupted
+		}
+
+		scroll := map[string]interface{}{"scroll": "10m", "scroll_id": scrollresponse.ScrollID}
+		sresponse, err := rt.doPostCtx(rt.ctx, "_search/scroll", scroll, c.conf.Name)
+		if rt.stopping() {
+			log.Println("Export interrupted by shutdown:", filePath)
+			return errInterrupted
+		}
+		if err != nil {
+			log.Println("Failed to get scroll batch: ", err)
+			return err
+		}
+		if err := json.Unmarshal(sresponse, &scrollresponse); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
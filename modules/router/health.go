@@ -0,0 +1,134 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/version"
+)
+
+type checkResult struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration_ms"`
+}
+
+type readyResult struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checked_at"`
+	Checks    map[string]checkResult `json:"checks"`
+}
+
+// readiness caches the last result so frequent probes don't hammer the clusters
+type readiness struct {
+	sync.Mutex
+	last readyResult
+	down atomic.Bool // началась остановка
+}
+
+func runCheck(f func() error) checkResult {
+	start := time.Now()
+	err := f()
+	res := checkResult{OK: err == nil, Duration: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// probe sends one GET to the cluster without the retry policy, bounded by app.ready_timeout
+func (rt *Router) probe(c *esCluster, path string) error {
+	ctx, cancel := context.WithTimeout(rt.ctx, time.Duration(rt.config().App.ReadyTimeout)*time.Second)
+	defer cancel()
+	resp, err := rt.performOnce(ctx, c, "GET", path, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Wrong response: " + resp.Status)
+	}
+	return nil
+}
+
+func (rt *Router) checkReady() readyResult {
+	// во время остановки кластеры не проверяем, сразу выводим из балансировки
+	if rt.ready.down.Load() || rt.stopping() {
+		return readyResult{Status: "shutting_down", CheckedAt: time.Now(), Checks: map[string]checkResult{}}
+	}
+
+	rt.ready.Lock()
+	defer rt.ready.Unlock()
+
+	ttl := time.Duration(rt.config().App.ReadyCache) * time.Second
+	if !rt.ready.last.CheckedAt.IsZero() && time.Since(rt.ready.last.CheckedAt) < ttl {
+		return rt.ready.last
+	}
+
+	res := readyResult{Status: "ok", CheckedAt: time.Now(), Checks: make(map[string]checkResult)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	check := func(name string, f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := runCheck(f)
+			mu.Lock()
+			res.Checks[name] = r
+			mu.Unlock()
+		}()
+	}
+	for _, c := range rt.cl.all() {
+		c := c
+		check("cluster:"+c.conf.Name, func() error {
+			return rt.probe(c, "_cluster/health")
+		})
+		if c.conf.CanRestore() {
+			check("repositories:"+c.conf.Name, func() error {
+				return rt.probe(c, "_cat/repositories?format=json")
+			})
+		}
+	}
+	check("export_dir", func() error {
+		f, err := os.CreateTemp("/tmp/data", ".readyz-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	})
+	wg.Wait()
+
+	for _, c := range res.Checks {
+		if !c.OK {
+			res.Status = "fail"
+		}
+	}
+	rt.ready.last = res
+	return res
+}
+
+// HealthHandler reports that the process is alive
+func (rt *Router) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Server", version.Version)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// ReadyHandler reports whether the clusters and the export directory are usable
+func (rt *Router) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	res := rt.checkReady()
+	j, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Server", version.Version)
+	if res.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(j)
+}
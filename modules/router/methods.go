@@ -14,20 +14,20 @@
 package router
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"strings"
 
-	"bytes"
-	"net"
 	"regexp"
 	"time"
 
+	"github.com/flant/elasticsearch-extractor/modules/audit"
+	"github.com/flant/elasticsearch-extractor/modules/config"
 	"github.com/uzhinskiy/lib.go/helpers"
 )
 
@@ -44,55 +44,31 @@ type esError struct {
 }
 
 func (rt *Router) netClientPrepare() {
-	tlsClientConfig := createTLSConfig(rt.conf.Snapshot.CAcert, rt.conf.Snapshot.ClientCert,
-		rt.conf.Snapshot.ClientKey, rt.conf.Snapshot.InsecureSkipVerify)
-	var netTransport = &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: time.Duration(rt.conf.App.TimeOut) * time.Second,
-		}).Dial,
-		TLSClientConfig: tlsClientConfig,
-	}
-
-	rt.nc["Snapshot"] = &http.Client{
-		Timeout:   time.Second * time.Duration(rt.conf.App.TimeOut),
-		Transport: netTransport,
-	}
-
-	if rt.conf.Search.Host != "" {
-		tlsClientConfig := createTLSConfig(rt.conf.Search.CAcert, rt.conf.Search.ClientCert,
-			rt.conf.Search.ClientKey, rt.conf.Search.InsecureSkipVerify)
-		var netTransport = &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout: time.Duration(rt.conf.App.TimeOut) * time.Second,
-			}).Dial,
-			TLSClientConfig: tlsClientConfig,
-		}
-
-		rt.nc["Search"] = &http.Client{
-			Timeout:   time.Second * time.Duration(rt.conf.App.TimeOut),
-			Transport: netTransport,
-		}
-
+	cl, err := newClusterRegistry(rt.conf)
+	if err != nil {
+		log.Fatalf("cannot prepare clusters: %s\n", err)
 	}
-
+	rt.cl = cl
 }
 
-func (rt *Router) doDel(url string, cluster string) ([]byte, error) {
-
-	actionRequest, _ := http.NewRequest("DELETE", url, nil)
-	actionRequest.Header.Set("Content-Type", "application/json")
-	actionRequest.Header.Set("Connection", "keep-alive")
-	if cluster == "Search" {
-		if rt.conf.Search.Username != "" {
-			actionRequest.SetBasicAuth(rt.conf.Search.Username, rt.conf.Search.Password)
-		}
-	} else {
-		if rt.conf.Snapshot.Username != "" {
-			actionRequest.SetBasicAuth(rt.conf.Snapshot.Username, rt.conf.Snapshot.Password)
+// endpointLabel keeps only the API part of the path (_search, _snapshot/_status ...) so
+// index and snapshot names do not blow up the metric cardinality
+func endpointLabel(p string) string {
+	var parts []string
+	for _, seg := range strings.Split(p, "/") {
+		if strings.HasPrefix(seg, "_") {
+			parts = append(parts, seg)
 		}
 	}
+	if len(parts) == 0 {
+		return "index"
+	}
+	return strings.Join(parts, "/")
+}
+
+func (rt *Router) doDel(path string, cluster string) ([]byte, error) {
 
-	actionResult, err := rt.nc[cluster].Do(actionRequest)
+	actionResult, err := rt.perform("DELETE", path, nil, cluster)
 	if actionResult != nil {
 		defer actionResult.Body.Close()
 	}
@@ -112,22 +88,9 @@ func (rt *Router) doDel(url string, cluster string) ([]byte, error) {
 	return body, nil
 }
 
-func (rt *Router) doGet(url string, cluster string) ([]byte, error) {
+func (rt *Router) doGet(path string, cluster string) ([]byte, error) {
 
-	actionRequest, _ := http.NewRequest("GET", url, nil)
-	actionRequest.Header.Set("Content-Type", "application/json")
-	actionRequest.Header.Set("Connection", "keep-alive")
-
-	if cluster == "Search" {
-		if rt.conf.Search.Username != "" {
-			actionRequest.SetBasicAuth(rt.conf.Search.Username, rt.conf.Search.Password)
-		}
-	} else {
-		if rt.conf.Snapshot.Username != "" {
-			actionRequest.SetBasicAuth(rt.conf.Snapshot.Username, rt.conf.Snapshot.Password)
-		}
-	}
-	actionResult, err := rt.nc[cluster].Do(actionRequest)
+	actionResult, err := rt.perform("GET", path, nil, cluster)
 	if actionResult != nil {
 		defer actionResult.Body.Close()
 	}
@@ -147,26 +110,14 @@ func (rt *Router) doGet(url string, cluster string) ([]byte, error) {
 	return body, nil
 }
 
-func (rt *Router) doPost(url string, request map[string]interface{}, cluster string) ([]byte, error) {
-	toBackend, _ := json.Marshal(request)
-
-	actionRequest, _ := http.NewRequest("POST", url, bytes.NewReader(toBackend))
-
-	actionRequest.Header.Set("Content-Type", "application/json")
-	actionRequest.Header.Set("Connection", "keep-alive")
-
-	if cluster == "Search" {
-		if rt.conf.Search.Username != "" {
-			actionRequest.SetBasicAuth(rt.conf.Search.Username, rt.conf.Search.Password)
-		}
+func (rt *Router) doPost(path string, request map[string]interface{}, cluster string) ([]byte, error) {
+	return rt.doPostCtx(context.Background(), path, request, cluster)
+}
 
-	} else {
-		if rt.conf.Snapshot.Username != "" {
-			actionRequest.SetBasicAuth(rt.conf.Snapshot.Username, rt.conf.Snapshot.Password)
-		}
-	}
+func (rt *Router) doPostCtx(ctx context.Context, path string, request map[string]interface{}, cluster string) ([]byte, error) {
+	toBackend, _ := json.Marshal(request)
 
-	actionResult, err := rt.nc[cluster].Do(actionRequest)
+	actionResult, err := rt.performCtx(ctx, "POST", path, toBackend, cluster)
 	if actionResult != nil {
 		defer actionResult.Body.Close()
 	}
@@ -188,15 +139,17 @@ func (rt *Router) doPost(url string, request map[string]interface{}, cluster str
 	return body, nil
 }
 
-func (rt *Router) getNodes() ([]singleNode, error) {
+func (rt *Router) getNodes(cluster string) ([]singleNode, error) {
 
 	var nresp []singleNode
 	var na nodesArray
 
-	//	rt.nodes.RLock()
-	//	defer rt.nodes.RUnlock()
+	c, err := rt.cl.get(cluster, config.RoleRestore)
+	if err != nil {
+		return nil, err
+	}
 
-	response, err := rt.doGet(rt.conf.Snapshot.Host+"_cat/nodes?format=json&bytes=b&h=ip,name,dt,du,dup,d&s=name", "Snapshot")
+	response, err := rt.doGet("_cat/nodes?format=json&bytes=b&h=ip,name,dt,du,dup,d&s=name", c.conf.Name)
 	if err != nil {
 		return nil, err
 	}
@@ -213,26 +166,20 @@ func (rt *Router) getNodes() ([]singleNode, error) {
 	}
 	na.sum = s
 	na.max = helpers.GetMaxValueInArray(na.list)
-	rt.nodes = na
+	c.Lock()
+	c.nodes = na
+	c.Unlock()
 	return nresp, nil
 
 }
 
 func (rt *Router) getIndexGroups(cluster string) ([]indexGroup, error) {
 	var igs, igresp []indexGroup
-	var host string
 	re := regexp.MustCompile(`^([\w\d\-_\.]+)-(\d{4}\.\d{2}\.\d{2}(-\d{2})*)`)
 
-	//	rt.nodes.RLock()
-	//	defer rt.nodes.RUnlock()
 	t := time.Now()
-	if cluster == "Snapshot" {
-		host = rt.conf.Snapshot.Host
-	} else if cluster == "Search" {
-		host = rt.conf.Search.Host
-	}
 
-	response, err := rt.doGet(host+"_cat/indices/*-"+t.Format("2006.01.02")+"*,*-"+t.Format("02-01-2006")+",-.*/?format=json&h=index", cluster)
+	response, err := rt.doGet("_cat/indices/*-"+t.Format("2006.01.02")+"*,*-"+t.Format("02-01-2006")+",-.*/?format=json&h=index", cluster)
 	if err != nil {
 		return nil, err
 	}
@@ -245,12 +192,36 @@ func (rt *Router) getIndexGroups(cluster string) ([]indexGroup, error) {
 		n.Index = match[1] + "-*"
 		igresp = append(igresp, n)
 	}
+	// потоки данных ищутся по имени потока, а не по датированным индексам
+	c, err := rt.cl.get(cluster, config.RoleSearch)
+	if err != nil {
+		return nil, err
+	}
+	if c.supports(featureDataStreams) == nil {
+		response, err := rt.doGet("_data_stream?format=json", cluster)
+		if err != nil {
+			log.Println("Cannot list data streams:", err)
+		} else {
+			var ds struct {
+				DataStreams []struct {
+					Name string `json:"name"`
+				} `json:"data_streams"`
+			}
+			if err := json.Unmarshal(response, &ds); err == nil {
+				for _, d := range ds.DataStreams {
+					if !strings.HasPrefix(d.Name, ".") {
+						igresp = append(igresp, indexGroup{Index: d.Name})
+					}
+				}
+			}
+		}
+	}
 	unique := removeDuplicates(igresp)
 	return unique, nil
 
 }
 
-func (rt *Router) Barrel(ind_array IndicesInSnap, s3 bool) ([]string, []string) {
+func (rt *Router) Barrel(c *esCluster, ind_array IndicesInSnap) ([]string, []string) {
 	var (
 		k  int
 		Sk int
@@ -258,11 +229,13 @@ func (rt *Router) Barrel(ind_array IndicesInSnap, s3 bool) ([]string, []string)
 		b  []string
 	)
 
+	c.RLock()
+	defer c.RUnlock()
 	for name, ind := range ind_array {
-		if !s3 {
-			for n := range rt.nodes.list {
+		if !c.conf.IsS3 {
+			for n := range c.nodes.list {
 				for m := range ind.Shards {
-					k = rt.nodes.list[n] / ind.Shards[m]
+					k = c.nodes.list[n] / ind.Shards[m]
 					Sk = Sk + k
 				}
 			}
@@ -298,7 +271,7 @@ func (rt *Router) flattenMap(prefix string, nestedMap map[string]interface{}, fl
 	}
 }
 
-func (rt *Router) saveHintsToJsonFile(request apiRequest) error {
+func (rt *Router) saveHintsToJsonFile(request apiRequest, ev *audit.Event) (err error) {
 	var (
 		use_source     string
 		query          string
@@ -313,17 +286,19 @@ func (rt *Router) saveHintsToJsonFile(request apiRequest) error {
 		req            map[string]interface{}
 		scrollresponse scrollResponse
 		fields_list    []string
-		host           string
 		request_batch  int64
 	)
 
-	request_batch = rt.conf.Search.RequestBatch
+	if !rt.jobs.start() {
+		return errShuttingDown
+	}
+	defer rt.jobs.done()
 
-	if request.Search.Cluster == "Snapshot" {
-		host = rt.conf.Snapshot.Host
-	} else if request.Search.Cluster == "Search" {
-		host = rt.conf.Search.Host
+	c, err := rt.cl.get(request.Search.Cluster, config.RoleSearch)
+	if err != nil {
+		return err
 	}
+	request_batch = c.conf.RequestBatch
 
 	ds, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateStart+" (MSK)")
 	de, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateEnd+" (MSK)")
@@ -370,8 +345,8 @@ func (rt *Router) saveHintsToJsonFile(request apiRequest) error {
 	query = fmt.Sprintf(`"query": { "bool": { "must": [ %s ],"filter": [  %s  %s ], "should": [],"must_not": [ %s ] }}`, xql, tf, filters, must_not)
 
 	full_query = fmt.Sprintf(`{"size": %d, %s, %s, %s, %s }`, request_batch, sort, use_source, fields, query)
-	fmt.Println("full_query", full_query)
-	err := json.Unmarshal([]byte(full_query), &req)
+	ev.Query = full_query
+	err = json.Unmarshal([]byte(full_query), &req)
 	if err != nil {
 		return err
 	}
@@ -383,19 +358,36 @@ func (rt *Router) saveHintsToJsonFile(request apiRequest) error {
 		return err
 	}
 	defer f.Close()
+	// прерванная по любой причине выгрузка не должна выглядеть завершенной
+	defer func() {
+		if err != nil {
+			markIncomplete(filePath)
+		}
+	}()
 
 	scrollId := ""
+	defer func() {
+		rt.clearScroll(c.conf.Name, scrollId)
+	}()
 	for {
 		sresponse := []byte{}
 		if scrollId == "" {
-			r, err := rt.doPost(host+request.Search.Index+"/_search?scroll=10m", req, "Search")
+			r, err := rt.doPostCtx(rt.ctx, request.Search.Index+"/_search?scroll=10m", req, c.conf.Name)
 			if err != nil {
 				return err
 			}
 			sresponse = r
 		} else {
+			if rt.stopping() {
+				log.Println("Export interrupted by shutdown:", filePath)
+				return errInterrupted
+			}
 			scroll := map[string]interface{}{"scroll": "10m", "scroll_id": scrollId}
-			r, err := rt.doPost(host+"_search/scroll", scroll, "Search")
+			r, err := rt.doPostCtx(rt.ctx, "_search/scroll", scroll, c.conf.Name)
+			if rt.stopping() {
+				log.Println("Export interrupted by shutdown:", filePath)
+				return errInterrupted
+			}
 			if err != nil {
 				return err
 			}
@@ -414,7 +406,6 @@ func (rt *Router) saveHintsToJsonFile(request apiRequest) error {
 		log.Println("scrollId", scrollId)
 
 		if len(scrollresponse.HitsRoot.Hits) == 0 {
-			_, _ = rt.doDel(request.Search.Cluster+"_search/scroll/"+scrollresponse.ScrollID, "Search")
 			log.Println("Search is done!")
 			break
 		}
@@ -447,6 +438,7 @@ func (rt *Router) saveHintsToJsonFile(request apiRequest) error {
 			if err != nil {
 				return err
 			}
+			ev.Rows++
 		}
 
 		fileInfo, err := os.Stat(filePath)
@@ -454,7 +446,8 @@ func (rt *Router) saveHintsToJsonFile(request apiRequest) error {
 			return err
 		}
 
-		if fileInfo.Size() > rt.conf.Search.FileLimit.Size {
+		ev.Bytes = fileInfo.Size()
+		if ev.Bytes > c.conf.FileLimit.Size {
 			return errors.New(fmt.Sprintf("file %s with size %d is too big", filePath, fileInfo.Size()))
 		}
 	}
@@ -0,0 +1,154 @@
+package router
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/audit"
+	"github.com/flant/elasticsearch-extractor/modules/config"
+	"github.com/flant/elasticsearch-extractor/modules/metrics"
+)
+
+func (rt *Router) config() config.Config {
+	rt.confMu.RLock()
+	defer rt.confMu.RUnlock()
+	return rt.conf
+}
+
+func (rt *Router) auditLogger() *audit.Logger {
+	rt.confMu.RLock()
+	defer rt.confMu.RUnlock()
+	return rt.al
+}
+
+// startCluster runs the background work of a new cluster: version detection (again
+// after a node comes back), node sniffing and the initial disk usage stats for restore clusters
+func (rt *Router) startCluster(c *esCluster) {
+	c.pool.setOnRecover(func() { go rt.detect(c) })
+	rt.detect(c)
+	if c.conf.Sniff {
+		go rt.sniffLoop(c)
+	}
+	if c.conf.CanRestore() {
+		_, err := rt.getNodes(c.conf.Name)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// reload parses the config file again and applies it. An invalid config is rejected
+// as a whole and the running one is kept. Listen address and server TLS settings
+// cannot be changed without a restart.
+func (rt *Router) reload() error {
+	nc, err := config.Parse(rt.configFile)
+	if err != nil {
+		return err
+	}
+	old := rt.config()
+
+	if nc.App.Port != old.App.Port || nc.App.Bind != old.App.Bind || nc.App.TLS != old.App.TLS {
+		log.Println("Reload: app.port, app.bind and app.tls are applied only on restart")
+		nc.App.Port, nc.App.Bind, nc.App.TLS = old.App.Port, old.App.Bind, old.App.TLS
+	}
+
+	if nc.Catalog.Path != old.Catalog.Path {
+		log.Println("Reload: catalog.path is applied only on restart")
+		nc.Catalog.Path = old.Catalog.Path
+	}
+
+	changes := config.Diff(old, nc)
+	if len(changes) == 0 {
+		log.Println("Reload: no changes")
+		return nil
+	}
+
+	al := rt.auditLogger()
+	auditChanged := !reflect.DeepEqual(old.Audit, nc.Audit)
+	if auditChanged {
+		al, err = rt.newAuditLogger(nc)
+		if err != nil {
+			return err
+		}
+	}
+
+	started, stopped, err := rt.cl.update(nc)
+	if err != nil {
+		if auditChanged {
+			al.Close()
+		}
+		return err
+	}
+
+	rt.confMu.Lock()
+	prevAl := rt.al
+	rt.conf = nc
+	rt.al = al
+	rt.confMu.Unlock()
+	if auditChanged {
+		prevAl.Close()
+	}
+
+	for _, c := range stopped {
+		c.stop()
+		rt.snaps.dropCluster(c.conf.Name)
+	}
+	for _, c := range started {
+		log.Printf("Reload: cluster %s rebuilt\n", c.conf.Name)
+		rt.startCluster(c)
+	}
+
+	rt.ready.Lock()
+	rt.ready.last = readyResult{}
+	rt.ready.Unlock()
+
+	if len(started) > 0 || len(stopped) > 0 {
+		go rt.refreshCatalog()
+	}
+
+	log.Printf("Reload: applied changes: %v\n", changes)
+	return nil
+}
+
+// watchConfig reloads the config on SIGHUP and when the file modification time changes
+func (rt *Router) watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	modTime := func() time.Time {
+		fi, err := os.Stat(rt.configFile)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+	mt := modTime()
+
+	for {
+		select {
+		case <-rt.ctx.Done():
+			return
+		case <-hup:
+			log.Println("Reload: got SIGHUP")
+		case <-time.After(time.Duration(rt.config().App.ReloadInterval) * time.Second):
+			t := modTime()
+			if t.Equal(mt) {
+				continue
+			}
+			log.Println("Reload: config file changed")
+		}
+		mt = modTime()
+
+		if err := rt.reload(); err != nil {
+			metrics.ConfigReloads.WithLabelValues("failure").Inc()
+			log.Printf("Reload: keeping the current config: %s\n", err)
+			continue
+		}
+		metrics.ConfigReloads.WithLabelValues("success").Inc()
+	}
+}
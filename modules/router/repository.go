@@ -0,0 +1,163 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errRepositoryMissing = errors.New("repository not found")
+
+// repoSnapshot is a snapshot get_repository points at, with its age by start time
+type repoSnapshot struct {
+	Snapshot  string `json:"snapshot"`
+	State     string `json:"state"`
+	StartTime int64  `json:"start_time_in_millis"`
+	Age       int64  `json:"age_seconds"`
+}
+
+type repoVerify struct {
+	Nodes []string `json:"nodes,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+type repositoryDetail struct {
+	Name          string                 `json:"name"`
+	Type          string                 `json:"type"`
+	Settings      map[string]interface{} `json:"settings"`
+	Bucket        string                 `json:"bucket,omitempty"`
+	BasePath      string                 `json:"base_path,omitempty"`
+	Readonly      bool                   `json:"readonly"`
+	Verify        *repoVerify            `json:"verify,omitempty"`
+	Snapshots     int                    `json:"snapshots"`
+	Failed        int                    `json:"failed"`
+	Partial       int                    `json:"partial"`
+	LatestSuccess *repoSnapshot          `json:"latest_success,omitempty"`
+	Newest        *repoSnapshot          `json:"newest,omitempty"`
+	StaleAfter    int                    `json:"stale_after_hours"`
+	Stale         bool                   `json:"stale"`
+	CatalogTime   *time.Time             `json:"catalog_time,omitempty"`
+}
+
+// ключи настроек, которые не показываются (старые версии хранили в них ключи доступа)
+var hiddenRepoSettings = []string{"access_key", "secret_key", "session_token", "password"}
+
+// repositoryDetail reads the settings of the repository and sums up its snapshots; with
+// verify the repository is checked by _verify on all nodes
+func (rt *Router) repositoryDetail(c *esCluster, repo string, verify, refresh bool) (repositoryDetail, error) {
+	d := repositoryDetail{Name: repo, StaleAfter: c.conf.StaleAfter}
+	response, err := rt.doGet("_snapshot/"+repo+"?format=json", c.conf.Name)
+	if err != nil {
+		return d, err
+	}
+	var repos map[string]struct {
+		Type     string                 `json:"type"`
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := json.Unmarshal(response, &repos); err != nil {
+		return d, err
+	}
+	r, ok := repos[repo]
+	if !ok {
+		return d, errRepositoryMissing
+	}
+	d.Type = r.Type
+	d.Settings = make(map[string]interface{})
+	for k, v := range r.Settings {
+		hidden := false
+		for _, h := range hiddenRepoSettings {
+			if strings.Contains(k, h) {
+				hidden = true
+			}
+		}
+		if !hidden {
+			d.Settings[k] = v
+		}
+	}
+	d.Bucket, _ = d.Settings["bucket"].(string)
+	d.BasePath, _ = d.Settings["base_path"].(string)
+	if d.BasePath == "" {
+		d.BasePath, _ = d.Settings["location"].(string)
+	}
+	// настройки приходят строками: "readonly": "true"
+	switch v := d.Settings["readonly"].(type) {
+	case bool:
+		d.Readonly = v
+	case string:
+		d.Readonly = v == "true"
+	}
+
+	if verify {
+		d.Verify = rt.verifyRepository(c, repo)
+	}
+
+	var items []snapItem
+	fromCatalog := false
+	if !refresh {
+		var refreshed time.Time
+		items, refreshed, fromCatalog = rt.catalogSnapshots(c, repo)
+		if fromCatalog {
+			d.CatalogTime = &refreshed
+		}
+	}
+	if !fromCatalog {
+		items, err = rt.cachedSnapshots(c, repo, refresh)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	now := time.Now()
+	for _, s := range items {
+		d.Snapshots++
+		switch s.State {
+		case "FAILED":
+			d.Failed++
+		case "PARTIAL":
+			d.Partial++
+		}
+		rs := &repoSnapshot{
+			Snapshot:  s.Snapshot,
+			State:     s.State,
+			StartTime: s.StartTime,
+			Age:       int64(now.Sub(time.UnixMilli(s.StartTime)).Seconds()),
+		}
+		if d.Newest == nil || s.StartTime > d.Newest.StartTime {
+			d.Newest = rs
+		}
+		if s.State == "SUCCESS" && (d.LatestSuccess == nil || s.StartTime > d.LatestSuccess.StartTime) {
+			d.LatestSuccess = rs
+		}
+	}
+	// пустой репозиторий тоже считается устаревшим
+	d.Stale = d.Newest == nil || d.Newest.Age > int64(d.StaleAfter)*3600
+	return d, nil
+}
+
+// verifyRepository runs _verify; a failed check is reported in the answer, not as an error
+func (rt *Router) verifyRepository(c *esCluster, repo string) *repoVerify {
+	response, err := rt.doPost("_snapshot/"+repo+"/_verify", map[string]interface{}{}, c.conf.Name)
+	if err != nil {
+		msg := err.Error()
+		if msg == "" {
+			msg = "verification failed"
+		}
+		return &repoVerify{Error: msg}
+	}
+	var vr struct {
+		Nodes map[string]struct {
+			Name string `json:"name"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(response, &vr); err != nil {
+		return &repoVerify{Error: err.Error()}
+	}
+	v := &repoVerify{Nodes: []string{}}
+	for _, n := range vr.Nodes {
+		v.Nodes = append(v.Nodes, n.Name)
+	}
+	sort.Strings(v.Nodes)
+	return v
+}
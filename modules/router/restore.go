@@ -0,0 +1,527 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/catalog"
+	"github.com/flant/elasticsearch-extractor/modules/metrics"
+)
+
+var errRestoreBusy = errors.New("Indices will not be restored at now. Please wait")
+
+// checkRestoreHealth refuses new restores while earlier ones are still being recovered
+func (rt *Router) checkRestoreHealth(c *esCluster) error {
+	ch_response, err := rt.doGet("_cluster/health/extracted*", c.conf.Name)
+	if err != nil {
+		return err
+	}
+	var ch_status ClusterHealth
+	if err := json.Unmarshal(ch_response, &ch_status); err != nil {
+		return err
+	}
+	// Если в кластере есть недовосстановленные индексы - прерываем
+	if ch_status.InitializingShards > 5 || ch_status.UnassignedShards > 5 {
+		return errRestoreBusy
+	}
+	return nil
+}
+
+// snapshotShards reads the size of the indices and of their shards from the snapshot status,
+// for the capacity check
+func (rt *Router) snapshotShards(c *esCluster, repo, snapshot string, names []string, indices IndicesInSnap) error {
+	status_response, err := rt.doGet("_snapshot/"+repo+"/"+snapshot+"/_status", c.conf.Name)
+	if err != nil {
+		return err
+	}
+	var snap_status snapStatus
+	if err := json.Unmarshal(status_response, &snap_status); err != nil {
+		return err
+	}
+	if len(snap_status.Snapshots) == 0 {
+		return fmt.Errorf("snapshot %s/%s not found", repo, snapshot)
+	}
+	statusShards(snap_status, names, indices)
+	return nil
+}
+
+// statusShards fills the indices with the sizes of their shards from the snapshot status.
+// The shards that failed in a PARTIAL snapshot have no size and take no space, they are skipped.
+func statusShards(snap_status snapStatus, names []string, indices IndicesInSnap) {
+	for _, iname := range names {
+		ind := snap_status.Snapshots[0].Indices[iname]
+		indices[iname] = &IndexInSnap{Name: iname, Size: ind.Stats.Total.Size}
+		if ind.ShardsStats.Total > 0 {
+			for s := range ind.Shards {
+				if size := ind.Shards[s].Stats.Total.Size; size > 0 {
+					indices[iname].Shards = append(indices[iname].Shards, size)
+				}
+			}
+		}
+	}
+}
+
+// submitRestore starts the restore of the indices as extracted_<index>-<date>. With partial
+// the shards that failed in the snapshot are created empty instead of failing the restore.
+func (rt *Router) submitRestore(c *esCluster, repo, snapshot string, indices []string, partial bool) ([]byte, error) {
+	t := time.Now()
+	req := map[string]interface{}{
+		"ignore_unavailable":   false,
+		"include_global_state": false,
+		"include_aliases":      false,
+		"partial":              partial,
+		"rename_pattern":       "(.+)",
+		"rename_replacement":   fmt.Sprintf("extracted_$1-%s", t.Format("02-01-2006")),
+		"indices":              indices,
+		"index_settings":       map[string]interface{}{"index.number_of_replicas": 0},
+	}
+	response, err := rt.doPost("_snapshot/"+repo+"/"+snapshot+"/_restore?wait_for_completion=false", req, c.conf.Name)
+	if err != nil {
+		metrics.RestoresFailed.Inc()
+		return response, err
+	}
+	metrics.RestoresStarted.Inc()
+	return response, nil
+}
+
+// restoreResponse is the answer of restore; error is 1 when some of the indices do not fit
+type restoreResponse struct {
+	Message     string   `json:"message"`
+	Restored    []string `json:"restored"`
+	NotRestored []string `json:"not_restored,omitempty"`
+	Error       int      `json:"error"`
+}
+
+// rangeSnapshot is a snapshot restore_range may take indices from
+type rangeSnapshot struct {
+	repo    string
+	name    string
+	start   int64
+	indices []string
+}
+
+type rangeRestore struct {
+	Repo        string   `json:"repository"`
+	Snapshot    string   `json:"snapshot"`
+	Indices     []string `json:"indices"`
+	NotRestored []string `json:"not_restored,omitempty"`
+	Status      string   `json:"status"` // started, failed или skipped (не хватило места)
+	Error       string   `json:"error,omitempty"`
+}
+
+// rangeDuplicate is an index found in several snapshots of the range; it is restored
+// from the newest one
+type rangeDuplicate struct {
+	Index    string `json:"index"`
+	Snapshot string `json:"snapshot"`
+	UsedFrom string `json:"used_from"`
+}
+
+type restoreRangeResponse struct {
+	Status     string           `json:"status"` // started, partial или failed
+	Restores   []rangeRestore   `json:"restores"`
+	Duplicates []rangeDuplicate `json:"duplicates,omitempty"`
+	Message    string           `json:"message"`
+	Error      int              `json:"error"`
+}
+
+// rangeSnapshots lists the successful snapshots of the repositories that started within
+// the date range of the filter, from the catalog where it has the repository; the ones
+// taken since the last catalog refresh are read from the cluster
+func (rt *Router) rangeSnapshots(c *esCluster, repos []string, f snapFilter) ([]rangeSnapshot, error) {
+	var res []rangeSnapshot
+	for _, repo := range repos {
+		known := make(map[string]bool)
+		var snaps []esSnapshot
+		var err error
+		if cached, _, ok := rt.catalog.Snapshots(c.conf.Name, repo); ok {
+			for _, s := range cached {
+				known[s.Name] = true
+				if !f.match(snapItem{State: s.State, StartTime: s.StartTime}) {
+					continue
+				}
+				rs := rangeSnapshot{repo: repo, name: s.Name, start: s.StartTime}
+				for _, idx := range s.Indices {
+					rs.indices = append(rs.indices, idx.Name)
+				}
+				res = append(res, rs)
+			}
+			if c.supports(featureSnapshotFromSort) == nil {
+				snaps, err = rt.newestSnapshots(c, repo, cached)
+			} else {
+				snaps, err = rt.fetchSnapshots(c, repo, "*")
+			}
+		} else {
+			snaps, err = rt.fetchSnapshots(c, repo, "*")
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range snaps {
+			if known[s.Snapshot] || !f.match(snapItem{State: s.State, StartTime: s.StartTimeInMillis}) {
+				continue
+			}
+			res = append(res, rangeSnapshot{repo: repo, name: s.Snapshot, start: s.StartTimeInMillis, indices: s.Indices})
+		}
+	}
+	return res, nil
+}
+
+// restoreRange restores the indices matching the pattern from all snapshots of the range
+// as one operation. An index found in several snapshots is restored from the newest one.
+// The capacity check is made once for all indices, then a restore is started for every
+// snapshot that has something to restore. With partial the shards that failed in a PARTIAL
+// snapshot are created empty, as in restore.
+func (rt *Router) restoreRange(c *esCluster, repos []string, pattern string, f snapFilter, partial bool) (restoreRangeResponse, error) {
+	var resp restoreRangeResponse
+
+	snaps, err := rt.rangeSnapshots(c, repos, f)
+	if err != nil {
+		return resp, err
+	}
+	sort.SliceStable(snaps, func(i, j int) bool { return snaps[i].start > snaps[j].start })
+
+	patterns := strings.Split(pattern, ",")
+	owner := make(map[string]*rangeSnapshot)
+	chosen := make(map[*rangeSnapshot][]string)
+	var order []*rangeSnapshot
+	for i := range snaps {
+		s := &snaps[i]
+		for _, idx := range s.indices {
+			if !catalog.MatchName(patterns, idx) {
+				continue
+			}
+			if prev, ok := owner[idx]; ok {
+				resp.Duplicates = append(resp.Duplicates, rangeDuplicate{Index: idx, Snapshot: s.repo + "/" + s.name, UsedFrom: prev.repo + "/" + prev.name})
+				continue
+			}
+			owner[idx] = s
+			if len(chosen[s]) == 0 {
+				order = append(order, s)
+			}
+			chosen[s] = append(chosen[s], idx)
+		}
+	}
+	if len(order) == 0 {
+		return resp, nil
+	}
+
+	if err := rt.checkRestoreHealth(c); err != nil {
+		return resp, err
+	}
+
+	indices := make(IndicesInSnap)
+	for _, s := range order {
+		if err := rt.snapshotShards(c, s.repo, s.name, chosen[s], indices); err != nil {
+			return resp, err
+		}
+	}
+	allowed, _ := rt.Barrel(c, indices)
+	ok := make(map[string]bool)
+	for _, name := range allowed {
+		ok[name] = true
+	}
+
+	started, failed := 0, 0
+	for _, s := range order {
+		rr := rangeRestore{Repo: s.repo, Snapshot: s.name}
+		for _, idx := range chosen[s] {
+			if ok[idx] {
+				rr.Indices = append(rr.Indices, idx)
+			} else {
+				rr.NotRestored = append(rr.NotRestored, idx)
+			}
+		}
+		if len(rr.Indices) == 0 {
+			rr.Status = "skipped"
+		} else if _, err := rt.submitRestore(c, s.repo, s.name, rr.Indices, partial); err != nil {
+			rr.Status = "failed"
+			rr.Error = err.Error()
+			failed++
+		} else {
+			rr.Status = "started"
+			started++
+		}
+		resp.Restores = append(resp.Restores, rr)
+	}
+
+	var restored, notRestored []string
+	for _, rr := range resp.Restores {
+		if rr.Status == "started" {
+			restored = append(restored, rr.Indices...)
+		} else {
+			notRestored = append(notRestored, rr.Indices...)
+		}
+		notRestored = append(notRestored, rr.NotRestored...)
+	}
+	switch {
+	case started == 0:
+		resp.Status = "failed"
+	case failed > 0 || len(notRestored) > 0:
+		resp.Status = "partial"
+	default:
+		resp.Status = "started"
+	}
+	resp.Message = fmt.Sprintf("Indices '%v' will be restored from %d snapshots", restored, started)
+	if partial {
+		resp.Message += ", shards missing in the snapshots will be empty"
+	}
+	if len(notRestored) > 0 {
+		resp.Message += fmt.Sprintf("; indices '%v' will not be restored", notRestored)
+		resp.Error = 1
+	}
+	return resp, nil
+}
+
+// missingShard is a primary shard of a restored index that holds no data: not allocated
+// after the restore or created empty by a partial restore
+type missingShard struct {
+	Shard           int    `json:"shard"`
+	State           string `json:"state"` // UNASSIGNED или EMPTY
+	Reason          string `json:"reason,omitempty"`
+	Details         string `json:"details,omitempty"`
+	SnapshotFailure string `json:"snapshot_failure,omitempty"`
+}
+
+type restoredIndex struct {
+	Index        string         `json:"index"`
+	Repository   string         `json:"repository,omitempty"`
+	Snapshot     string         `json:"snapshot,omitempty"`
+	Source       string         `json:"source,omitempty"` // имя индекса в снапшоте
+	DataDate     string         `json:"data_date,omitempty"`
+	Status       string         `json:"status"` // complete, recovering или incomplete
+	Shards       int            `json:"shards"`
+	Started      int            `json:"started"`
+	Recovering   int            `json:"recovering"`
+	Docs         int64          `json:"docs"`
+	ShardDocs    map[int]int64  `json:"shard_docs,omitempty"`         // документы в запущенных шардах
+	RestoredFrom string         `json:"restored_time_from,omitempty"` // время данных в запущенных шардах, не потерянных
+	RestoredTo   string         `json:"restored_time_to,omitempty"`
+	Missing      []missingShard `json:"missing,omitempty"`
+}
+
+type restoreReportResponse struct {
+	Indices    []restoredIndex `json:"indices"`
+	Incomplete int             `json:"incomplete"`
+}
+
+// restoreReport checks the primary shards of the restored indices: _cat/shards gives the
+// shards that were not allocated, _recovery the snapshot they came from and the shards
+// a partial restore created empty; the failures recorded in the snapshot explain both.
+// Snapshots keep no document counts, so for an incomplete index the report gives the
+// documents of every started shard and the time range they cover.
+func (rt *Router) restoreReport(c *esCluster, pattern, timefield string) (restoreReportResponse, error) {
+	resp := restoreReportResponse{Indices: []restoredIndex{}}
+
+	response, err := rt.doGet("_cat/shards/"+pattern+"?format=json&h=index,shard,prirep,state,docs,unassigned.reason,unassigned.details", c.conf.Name)
+	if err != nil {
+		return resp, err
+	}
+	var shards []struct {
+		Index   string `json:"index"`
+		Shard   string `json:"shard"`
+		Prirep  string `json:"prirep"`
+		State   string `json:"state"`
+		Docs    string `json:"docs"`
+		Reason  string `json:"unassigned.reason"`
+		Details string `json:"unassigned.details"`
+	}
+	if err := json.Unmarshal(response, &shards); err != nil {
+		return resp, err
+	}
+
+	response, err = rt.doGet(pattern+"/_recovery", c.conf.Name)
+	if err != nil {
+		return resp, err
+	}
+	var recovery map[string]struct {
+		Shards []struct {
+			Id      int    `json:"id"`
+			Type    string `json:"type"`
+			Stage   string `json:"stage"`
+			Primary bool   `json:"primary"`
+			Source  struct {
+				Repository string `json:"repository"`
+				Snapshot   string `json:"snapshot"`
+				Index      string `json:"index"`
+			} `json:"source"`
+		} `json:"shards"`
+	}
+	if err := json.Unmarshal(response, &recovery); err != nil {
+		return resp, err
+	}
+
+	indices := make(map[string]*restoredIndex)
+	get := func(name string) *restoredIndex {
+		if indices[name] == nil {
+			indices[name] = &restoredIndex{Index: name}
+		}
+		return indices[name]
+	}
+	// реплики при восстановлении не создаются, смотрим только первичные шарды
+	for _, sh := range shards {
+		if sh.Prirep != "p" {
+			continue
+		}
+		ri := get(sh.Index)
+		ri.Shards++
+		switch sh.State {
+		case "STARTED", "RELOCATING":
+			ri.Started++
+			if n, err := strconv.ParseInt(sh.Docs, 10, 64); err == nil {
+				ri.Docs += n
+				if ri.ShardDocs == nil {
+					ri.ShardDocs = make(map[int]int64)
+				}
+				id, _ := strconv.Atoi(sh.Shard)
+				ri.ShardDocs[id] = n
+			}
+		case "INITIALIZING":
+			ri.Recovering++
+		default:
+			id, _ := strconv.Atoi(sh.Shard)
+			ri.Missing = append(ri.Missing, missingShard{Shard: id, State: sh.State, Reason: sh.Reason, Details: sh.Details})
+		}
+	}
+	for name, rec := range recovery {
+		ri := get(name)
+		var empty []int
+		for _, sh := range rec.Shards {
+			if !sh.Primary {
+				continue
+			}
+			if sh.Source.Snapshot != "" && ri.Snapshot == "" {
+				ri.Repository, ri.Snapshot, ri.Source = sh.Source.Repository, sh.Source.Snapshot, sh.Source.Index
+			}
+			if sh.Type == "EMPTY_STORE" && sh.Stage == "DONE" {
+				empty = append(empty, sh.Id)
+			}
+		}
+		// шард, которого нет в снапшоте, при partial создается пустым; у обычных индексов все шарды такие
+		if ri.Snapshot == "" {
+			continue
+		}
+		for _, id := range empty {
+			ri.Missing = append(ri.Missing, missingShard{Shard: id, State: "EMPTY", Reason: "created empty by a partial restore"})
+			ri.Started--
+			delete(ri.ShardDocs, id)
+		}
+	}
+
+	failures := make(map[string]map[string]string)
+	for _, ri := range indices {
+		if len(ri.Missing) == 0 || ri.Snapshot == "" {
+			continue
+		}
+		key := ri.Repository + "/" + ri.Snapshot
+		if _, ok := failures[key]; !ok {
+			failures[key] = make(map[string]string)
+			snaps, err := rt.fetchSnapshots(c, ri.Repository, ri.Snapshot)
+			if err != nil {
+				log.Printf("Cluster %s: cannot read snapshot %s: %s\n", c.conf.Name, key, err)
+			}
+			for _, s := range snaps {
+				for _, f := range s.Failures {
+					failures[key][fmt.Sprintf("%s/%d", f.Index, f.ShardId)] = f.Reason
+				}
+			}
+		}
+		for i := range ri.Missing {
+			ri.Missing[i].SnapshotFailure = failures[key][fmt.Sprintf("%s/%d", ri.Source, ri.Missing[i].Shard)]
+		}
+	}
+
+	var incomplete []string
+	for _, ri := range indices {
+		if ri.Source != "" {
+			if d, ok := c.snapshotDate(ri.Source); ok {
+				ri.DataDate = d.Format("2006.01.02")
+			}
+		}
+		sort.Slice(ri.Missing, func(i, j int) bool { return ri.Missing[i].Shard < ri.Missing[j].Shard })
+		switch {
+		case len(ri.Missing) > 0:
+			ri.Status = "incomplete"
+			if ri.Started > 0 {
+				incomplete = append(incomplete, ri.Index)
+			}
+			resp.Incomplete++
+		case ri.Recovering > 0:
+			ri.Status = "recovering"
+			ri.ShardDocs = nil
+		default:
+			ri.Status = "complete"
+			ri.ShardDocs = nil
+		}
+	}
+
+	if len(incomplete) > 0 {
+		ranges, err := rt.dataRange(c, incomplete, timefield)
+		if err != nil {
+			log.Printf("Cluster %s: cannot read the time range of %v: %s\n", c.conf.Name, incomplete, err)
+		}
+		for name, r := range ranges {
+			indices[name].RestoredFrom, indices[name].RestoredTo = r[0], r[1]
+		}
+	}
+	for _, ri := range indices {
+		resp.Indices = append(resp.Indices, *ri)
+	}
+	sort.Slice(resp.Indices, func(i, j int) bool { return resp.Indices[i].Index < resp.Indices[j].Index })
+	return resp, nil
+}
+
+// dataRange returns the min and max of the time field in the started shards of the indices.
+// Documents are spread over shards by the hash of _id, so a missing shard lost documents
+// from the same range.
+func (rt *Router) dataRange(c *esCluster, names []string, timefield string) (map[string][2]string, error) {
+	req := map[string]interface{}{
+		"size": 0,
+		"aggs": map[string]interface{}{
+			"indices": map[string]interface{}{
+				"terms": map[string]interface{}{"field": "_index", "size": len(names)},
+				"aggs": map[string]interface{}{
+					"from": map[string]interface{}{"min": map[string]interface{}{"field": timefield}},
+					"to":   map[string]interface{}{"max": map[string]interface{}{"field": timefield}},
+				},
+			},
+		},
+	}
+	// шарды без данных не назначены, поиск по ним отвечает частичным результатом
+	response, err := rt.doPost(strings.Join(names, ",")+"/_search?ignore_unavailable=true&allow_partial_search_results=true", req, c.conf.Name)
+	if err != nil {
+		return nil, err
+	}
+	type bound struct {
+		Value *float64 `json:"value"`
+		Text  string   `json:"value_as_string"`
+	}
+	var sr struct {
+		Aggregations struct {
+			Indices struct {
+				Buckets []struct {
+					Key  string `json:"key"`
+					From bound  `json:"from"`
+					To   bound  `json:"to"`
+				} `json:"buckets"`
+			} `json:"indices"`
+		} `json:"aggregations"`
+	}
+	if err := json.Unmarshal(response, &sr); err != nil {
+		return nil, err
+	}
+	res := make(map[string][2]string)
+	for _, b := range sr.Aggregations.Indices.Buckets {
+		if b.From.Value == nil || b.To.Value == nil {
+			continue
+		}
+		res[b.Key] = [2]string{b.From.Text, b.To.Text}
+	}
+	return res, nil
+}
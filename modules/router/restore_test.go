@@ -0,0 +1,281 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/catalog"
+	"github.com/flant/elasticsearch-extractor/modules/config"
+)
+
+func TestStatusShards(t *testing.T) {
+	// в PARTIAL снапшоте упавший шард 1 индекса logs имеет нулевой размер
+	var st snapStatus
+	err := json.Unmarshal([]byte(`{"snapshots":[{"snapshot":"snap-1","state":"PARTIAL","indices":{
+		"logs":{"shards_stats":{"total":2},"stats":{"total":{"size_in_bytes":300}},
+			"shards":{"0":{"stats":{"total":{"size_in_bytes":300}}},"1":{"stats":{"total":{"size_in_bytes":0}}}}},
+		"audit":{"shards_stats":{"total":1},"stats":{"total":{"size_in_bytes":50}},
+			"shards":{"0":{"stats":{"total":{"size_in_bytes":50}}}}}}}]}`), &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices := make(IndicesInSnap)
+	statusShards(st, []string{"logs", "audit"}, indices)
+
+	tests := []struct {
+		name   string
+		size   int
+		shards []int
+	}{
+		{"logs", 300, []int{300}},
+		{"audit", 50, []int{50}},
+	}
+	for _, tt := range tests {
+		ind := indices[tt.name]
+		if ind == nil || ind.Size != tt.size || len(ind.Shards) != len(tt.shards) || ind.Shards[0] != tt.shards[0] {
+			t.Errorf("%s: got %+v, want size %d shards %v", tt.name, ind, tt.size, tt.shards)
+		}
+	}
+
+	// проверка места не делит на нулевой размер шарда
+	rt := &Router{}
+	c := &esCluster{nodes: nodesArray{list: []int{1000, 1000}}}
+	fit, notFit := rt.Barrel(c, indices)
+	if len(fit) != 2 || len(notFit) != 0 {
+		t.Errorf("Barrel = %v, %v, want both indices restored", fit, notFit)
+	}
+}
+
+// fakeES serves the snapshots of repository r1 and records the restores
+type fakeES struct {
+	sync.Mutex
+	snaps    []esSnapshot
+	restores []string // snapshot:index,index
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	var body interface{} = map[string]interface{}{}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/":
+		body = map[string]interface{}{"version": map[string]string{"number": "7.17.0"}}
+	case r.URL.Path == "/_snapshot":
+		body = map[string]interface{}{"r1": map[string]string{"type": "fs"}}
+	case strings.HasSuffix(r.URL.Path, "/_restore"):
+		if strings.Contains(parts[2], "fail") {
+			http.Error(w, `{"error":"repository is broken"}`, http.StatusInternalServerError)
+			return
+		}
+		var req struct {
+			Indices []string `json:"indices"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.restores = append(f.restores, parts[2]+":"+strings.Join(req.Indices, ","))
+		body = map[string]bool{"accepted": true}
+	case strings.HasSuffix(r.URL.Path, "/_status"):
+		indices := make(map[string]interface{})
+		for _, sn := range f.snaps {
+			if sn.Snapshot != parts[2] {
+				continue
+			}
+			for _, i := range sn.Indices {
+				indices[i] = map[string]interface{}{
+					"shards_stats": map[string]int{"total": 1},
+					"stats":        map[string]interface{}{"total": map[string]int{"size_in_bytes": 100}},
+					"shards":       map[string]interface{}{"0": map[string]interface{}{"stats": map[string]interface{}{"total": map[string]int{"size_in_bytes": 100}}}},
+				}
+			}
+		}
+		body = map[string]interface{}{"snapshots": []interface{}{map[string]interface{}{"snapshot": parts[2], "indices": indices}}}
+	case parts[0] == "_snapshot" && len(parts) == 3:
+		from, _ := strconv.ParseInt(r.URL.Query().Get("from_sort_value"), 10, 64)
+		var l []esSnapshot
+		for _, sn := range f.snaps {
+			if sn.StartTimeInMillis >= from {
+				l = append(l, sn)
+			}
+		}
+		body = map[string]interface{}{"snapshots": l}
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// newTestRouter returns a router with one restore cluster served by the handler
+func newTestRouter(t *testing.T, h http.Handler) (*Router, *esCluster) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	f := filepath.Join(t.TempDir(), "main.yml")
+	if err := os.WriteFile(f, []byte("clusters:\n  - name: test\n    host: "+srv.URL+"/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := &Router{conf: conf}
+	rt.ctx, rt.stop = context.WithCancel(context.Background())
+	t.Cleanup(rt.stop)
+	if rt.cl, err = newClusterRegistry(conf); err != nil {
+		t.Fatal(err)
+	}
+	if rt.catalog, err = catalog.Open(catalogSource{rt: rt}, ""); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rt.cl.get("test", config.RoleRestore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.detect(c)
+	c.nodes.list = []int{1 << 30}
+	return rt, c
+}
+
+func TestRestoreRange(t *testing.T) {
+	at := func(s string) int64 {
+		d, _ := time.Parse("2006-01-02 15:04", s)
+		return d.UnixMilli()
+	}
+	snaps := []esSnapshot{
+		{Snapshot: "s-0301", State: "SUCCESS", StartTimeInMillis: at("2024-03-01 01:00"), Indices: []string{"logs-a", "audit"}},
+		// два снапшота за день: индекс берется из более позднего
+		{Snapshot: "s-0302a", State: "SUCCESS", StartTimeInMillis: at("2024-03-02 01:00"), Indices: []string{"logs-a", "logs-b"}},
+		{Snapshot: "s-0302b", State: "SUCCESS", StartTimeInMillis: at("2024-03-02 13:00"), Indices: []string{"logs-b"}},
+		{Snapshot: "s-0303", State: "PARTIAL", StartTimeInMillis: at("2024-03-03 01:00"), Indices: []string{"logs-c"}},
+		{Snapshot: "s-0304-fail", State: "SUCCESS", StartTimeInMillis: at("2024-03-04 23:59"), Indices: []string{"logs-d"}},
+		{Snapshot: "s-0305", State: "FAILED", StartTimeInMillis: at("2024-03-05 01:00"), Indices: []string{"logs-e"}},
+		{Snapshot: "s-0310", State: "SUCCESS", StartTimeInMillis: at("2024-03-10 00:00"), Indices: []string{"logs-f"}},
+	}
+
+	tests := []struct {
+		name       string
+		pattern    string
+		from, to   string
+		partial    bool
+		status     string
+		restores   []string // snapshot:index,index:status
+		duplicates []string // index:snapshot<-used_from
+		started    []string // запросы _restore
+	}{
+		{"newest copy", "logs-*", "2024-03-01", "2024-03-02", false, "started",
+			[]string{"s-0302b:logs-b:started", "s-0302a:logs-a:started"},
+			[]string{"logs-b:s-0302a<-s-0302b", "logs-a:s-0301<-s-0302a"},
+			[]string{"s-0302b:logs-b", "s-0302a:logs-a"}},
+		{"one day", "logs-b", "2024-03-02", "2024-03-02", false, "started",
+			[]string{"s-0302b:logs-b:started"},
+			[]string{"logs-b:s-0302a<-s-0302b"},
+			[]string{"s-0302b:logs-b"}},
+		{"failed restore", "logs-*", "2024-03-03", "2024-03-05", false, "failed",
+			[]string{"s-0304-fail:logs-d:failed"}, nil, nil},
+		{"partial snapshots", "logs-c,logs-d", "2024-03-03", "2024-03-04", true, "partial",
+			[]string{"s-0304-fail:logs-d:failed", "s-0303:logs-c:started"}, nil,
+			[]string{"s-0303:logs-c"}},
+		{"list of patterns", "audit,logs-f", "2024-03-01", "2024-03-10", false, "started",
+			[]string{"s-0310:logs-f:started", "s-0301:audit:started"}, nil,
+			[]string{"s-0310:logs-f", "s-0301:audit"}},
+		{"empty range", "logs-*", "2024-03-06", "2024-03-09", false, "", nil, nil, nil},
+		{"no match", "metrics-*", "2024-03-01", "2024-03-10", false, "", nil, nil, nil},
+	}
+	// снапшоты читаются из кластера и из каталога; снапшот после обновления каталога берется из кластера
+	for _, mode := range []string{"cluster", "catalog"} {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				es := &fakeES{snaps: snaps}
+				rt, c := newTestRouter(t, es)
+				if mode == "catalog" {
+					es.snaps = snaps[:len(snaps)-1]
+					if err := rt.catalog.Refresh([]string{"test"}); err != nil {
+						t.Fatal(err)
+					}
+					es.snaps = snaps
+				}
+
+				var request apiRequest
+				request.Values.DateFrom, request.Values.DateTo = tt.from, tt.to
+				request.Values.State = "SUCCESS"
+				if tt.partial {
+					request.Values.State = "SUCCESS,PARTIAL"
+				}
+				f, err := newSnapFilter(&request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := rt.restoreRange(c, []string{"r1"}, tt.pattern, f, tt.partial)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var restores, duplicates []string
+				for _, rr := range resp.Restores {
+					restores = append(restores, rr.Snapshot+":"+strings.Join(rr.Indices, ",")+":"+rr.Status)
+				}
+				for _, d := range resp.Duplicates {
+					duplicates = append(duplicates, d.Index+":"+strings.TrimPrefix(d.Snapshot, "r1/")+"<-"+strings.TrimPrefix(d.UsedFrom, "r1/"))
+				}
+				if resp.Status != tt.status {
+					t.Errorf("status %q, want %q", resp.Status, tt.status)
+				}
+				if strings.Join(restores, " ") != strings.Join(tt.restores, " ") {
+					t.Errorf("restores %v, want %v", restores, tt.restores)
+				}
+				if strings.Join(duplicates, " ") != strings.Join(tt.duplicates, " ") {
+					t.Errorf("duplicates %v, want %v", duplicates, tt.duplicates)
+				}
+				if strings.Join(es.restores, " ") != strings.Join(tt.started, " ") {
+					t.Errorf("restore requests %v, want %v", es.restores, tt.started)
+				}
+			})
+		}
+	}
+}
+
+func TestRangeSnapshots(t *testing.T) {
+	at := func(s string) int64 {
+		d, _ := time.Parse("2006-01-02 15:04", s)
+		return d.UnixMilli()
+	}
+	es := &fakeES{snaps: []esSnapshot{
+		{Snapshot: "s-1", State: "SUCCESS", StartTimeInMillis: at("2024-03-01 00:00"), Indices: []string{"logs"}},
+		{Snapshot: "s-2", State: "SUCCESS", StartTimeInMillis: at("2024-03-01 12:00"), Indices: []string{"logs"}},
+		{Snapshot: ".s-hidden", State: "SUCCESS", StartTimeInMillis: at("2024-03-01 13:00"), Indices: []string{"logs"}},
+		{Snapshot: "s-3", State: "IN_PROGRESS", StartTimeInMillis: at("2024-03-01 23:00"), Indices: []string{"logs"}},
+	}}
+	rt, c := newTestRouter(t, es)
+	if err := rt.catalog.Refresh([]string{"test"}); err != nil {
+		t.Fatal(err)
+	}
+	// после обновления каталога: завершился s-3 и появился s-4
+	es.snaps[3].State = "SUCCESS"
+	es.snaps = append(es.snaps, esSnapshot{Snapshot: "s-4", State: "SUCCESS", StartTimeInMillis: at("2024-03-02 00:00"), Indices: []string{"logs"}})
+
+	var request apiRequest
+	request.Values.State, request.Values.DateFrom, request.Values.DateTo = "SUCCESS", "2024-03-01", "2024-03-01"
+	f, err := newSnapFilter(&request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snaps, err := rt.rangeSnapshots(c, []string{"r1"}, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range snaps {
+		got = append(got, s.name)
+	}
+	sort.Strings(got)
+	if want := "s-1 s-2 s-3"; strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
@@ -14,23 +14,27 @@
 package router
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"mime"
 	"net/http"
 	"os"
 	"path"
-	"reflect"
-	"regexp"
-	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 
 	"time"
 
+	"github.com/flant/elasticsearch-extractor/modules/audit"
+	"github.com/flant/elasticsearch-extractor/modules/catalog"
 	"github.com/flant/elasticsearch-extractor/modules/config"
 	"github.com/flant/elasticsearch-extractor/modules/front"
+	"github.com/flant/elasticsearch-extractor/modules/metrics"
 	"github.com/flant/elasticsearch-extractor/modules/version"
 	"github.com/uzhinskiy/lib.go/helpers"
 )
@@ -42,10 +46,17 @@ type Filter struct {
 }
 
 type Router struct {
-	conf  config.Config
-	nc    map[string]*http.Client
-	nodes nodesArray
-	sl    []snapItem
+	confMu     sync.RWMutex
+	conf       config.Config
+	configFile string
+	cl         *clusterRegistry
+	snaps      snapCache
+	catalog    *catalog.Catalog
+	al         *audit.Logger
+	ready      readiness
+	ctx        context.Context
+	stop       context.CancelFunc
+	jobs       jobGroup
 }
 
 type apiRequest struct {
@@ -57,6 +68,17 @@ type apiRequest struct {
 		OrderType string   `json:"otype,omitempty"`
 		Snapshot  string   `json:"snapshot,omitempty"`
 		Index     string   `json:"index,omitempty"`
+		Cluster   string   `json:"cluster,omitempty"`
+		Name      string   `json:"name,omitempty"`      // шаблон имени снапшота, можно с *
+		State     string   `json:"state,omitempty"`     // SUCCESS,PARTIAL,...
+		DateFrom  string   `json:"date_from,omitempty"` // 2006-01-02
+		DateTo    string   `json:"date_to,omitempty"`
+		Size      int      `json:"size,omitempty"`  // размер страницы
+		After     string   `json:"after,omitempty"` // курсор следующей страницы
+		Refresh   bool     `json:"refresh,omitempty"`
+		Verify    bool     `json:"verify,omitempty"`    // проверить репозиторий через _verify
+		Partial   bool     `json:"partial,omitempty"`   // восстанавливать снапшот без сбойных шардов
+		TimeField string   `json:"timefield,omitempty"` // поле времени для restore_report
 	} `json:"values,omitempty"`
 	Search struct {
 		Index       string            `json:"index,omitempty"`
@@ -74,6 +96,12 @@ type apiRequest struct {
 	} `json:"search,omitempty"`
 }
 
+type findIndexResponse struct {
+	BuiltAt     time.Time       `json:"built_at"`
+	CatalogTime time.Time       `json:"catalog_time"`
+	Matches     []catalog.Match `json:"matches"`
+}
+
 type snapStatus struct {
 	Snapshots []struct {
 		Snapshot string `json:"snapshot,omitempty"`
@@ -131,18 +159,64 @@ type indexGroup struct {
 }
 
 type Cluster struct {
-	Name string
-	Host string
-	Type string
+	Name         string
+	Host         string
+	Type         string
+	Roles        []string
+	Distribution string
+	Version      string
+	Features     []string
 }
 
 type snapResponse struct {
-	Snapshots []snapItem `json:"snapshots"`
+	Snapshots []esSnapshot `json:"snapshots"`
+	Next      string       `json:"next"`
+	Total     int          `json:"total"`
+}
+
+// esSnapshot is one entry of GET _snapshot as returned by the cluster
+type esSnapshot struct {
+	Snapshot          string            `json:"snapshot"`
+	Uuid              string            `json:"uuid"`
+	State             string            `json:"state"`
+	Indices           []string          `json:"indices"`
+	StartTimeInMillis int64             `json:"start_time_in_millis"`
+	EndTimeInMillis   int64             `json:"end_time_in_millis"`
+	DurationInMillis  int64             `json:"duration_in_millis"`
+	Failures          []snapshotFailure `json:"failures"`
+	Shards            struct {
+		Total      int `json:"total"`
+		Failed     int `json:"failed"`
+		Successful int `json:"successful"`
+	} `json:"shards"`
+	IndexDetails map[string]struct {
+		ShardCount  int   `json:"shard_count"`
+		SizeInBytes int64 `json:"size_in_bytes"`
+	} `json:"index_details"`
+}
+
+// snapshotFailure is a shard that could not be snapshotted
+type snapshotFailure struct {
+	Index   string `json:"index"`
+	ShardId int    `json:"shard_id"`
+	Reason  string `json:"reason"`
+	Status  string `json:"status"`
 }
+
 type snapItem struct {
 	Snapshot    string `json:"snapshot,omitempty"`
 	Uuid        string `json:"uuid,omitempty"`
 	State       string `json:"state,omitempty"`
+	StartTime   int64  `json:"start_time_in_millis"`
+	EndTime     int64  `json:"end_time_in_millis"`
+	Duration    int64  `json:"duration_in_millis"`
+	IndexCount  int    `json:"index_count"`
+	ShardsTotal int    `json:"shards_total"`
+	ShardsOK    int    `json:"shards_successful"`
+	ShardsFail  int    `json:"shards_failed"`
+	Failures    int    `json:"failures"`
+	Size        int64  `json:"size_in_bytes,omitempty"`
+	DataDate    string `json:"data_date,omitempty"`
 	CreateEpoch int64
 	CreateDate  string
 }
@@ -178,19 +252,42 @@ type ClusterHealth struct {
 
 type JSONRow map[string]interface{}
 
-func Run(cnf config.Config) {
+func Run(cnf config.Config, configFile string) {
 	rt := Router{}
 	rt.conf = cnf
-	rt.nc = make(map[string]*http.Client)
+	rt.configFile = configFile
+	rt.ctx, rt.stop = context.WithCancel(context.Background())
 	rt.netClientPrepare()
-	_, err := rt.getNodes()
+	rt.auditPrepare()
+	for _, c := range rt.cl.all() {
+		rt.startCluster(c)
+	}
+	var err error
+	rt.catalog, err = catalog.Open(catalogSource{rt: &rt}, cnf.Catalog.Path)
 	if err != nil {
-		log.Println(err)
+		log.Fatalf("cannot open the snapshot catalog: %s\n", err)
 	}
+	go rt.catalogLoop()
+	go rt.watchConfig()
 
 	http.HandleFunc("/", rt.FrontHandler)
 	http.HandleFunc("/api/", rt.ApiHandler)
-	http.ListenAndServe(cnf.App.Bind+":"+cnf.App.Port, nil)
+	http.Handle("/metrics", metrics.Handler())
+	http.HandleFunc("/healthz", rt.HealthHandler)
+	http.HandleFunc("/readyz", rt.ReadyHandler)
+
+	srv := &http.Server{Addr: cnf.App.Bind + ":" + cnf.App.Port}
+	if cnf.App.TLS.Cert != "" {
+		tlsConfig, err := createServerTLSConfig(cnf.App.TLS.Cert, cnf.App.TLS.Key, cnf.App.TLS.MinVersion,
+			cnf.App.TLS.ClientCA, cnf.App.TLS.ClientAuth)
+		if err != nil {
+			log.Fatalf("cannot configure TLS: %s\n", err)
+		}
+		srv.TLSConfig = tlsConfig
+		rt.serve(srv, func() error { return srv.ListenAndServeTLS("", "") })
+		return
+	}
+	rt.serve(srv, srv.ListenAndServe)
 }
 
 // web-ui
@@ -254,18 +351,45 @@ func (rt *Router) FrontHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Server", version.Version)
 	if strings.Contains(file, ".html") {
 		t := template.Must(template.New("index").Parse(string(data)))
-		t.Execute(w, rt.conf.App.Kibana)
+		t.Execute(w, rt.config().App.Kibana)
 	} else {
 		w.Write(data)
 	}
 }
 
+func observeExport(format string, start time.Time, ev *audit.Event) {
+	metrics.ExportRows.WithLabelValues(format).Add(float64(ev.Rows))
+	metrics.ExportBytes.WithLabelValues(format).Add(float64(ev.Bytes))
+	metrics.ExportDuration.WithLabelValues(format).Observe(time.Since(start).Seconds())
+}
+
 func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 	var request apiRequest
 
 	defer r.Body.Close()
 	remoteIP := helpers.GetIP(r.RemoteAddr, r.Header.Get("X-Real-IP"), r.Header.Get("X-Forwarded-For"))
 
+	sw := &statusWriter{ResponseWriter: w}
+	w = sw
+	start := time.Now()
+	decoded := false
+	defer func() {
+		if r.Method == "OPTIONS" {
+			return
+		}
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		// действие из недочитанного запроса в метки не попадает
+		action := "unknown"
+		if decoded {
+			action = actionLabel(request.Action)
+		}
+		metrics.APIRequests.WithLabelValues(action, strconv.Itoa(status)).Inc()
+		metrics.APIDuration.WithLabelValues(action, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	}()
+
 	w.Header().Add("Access-Control-Allow-Origin", "*")
 	w.Header().Add("Access-Control-Allow-Methods", "POST,OPTIONS")
 	w.Header().Add("Access-Control-Allow-Credentials", "true")
@@ -288,10 +412,38 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 		log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
 		return
 	}
+	decoded = true
+
+	var sc *esCluster
+	if restoreActions[request.Action] {
+		sc, err = rt.cl.get(request.Values.Cluster, config.RoleRestore)
+	} else if searchActions[request.Action] {
+		sc, err = rt.cl.get(request.Search.Cluster, config.RoleSearch)
+	}
+	if err != nil {
+		msg := fmt.Sprintf(`{"error":"%s"}`, err)
+		http.Error(w, msg, http.StatusBadRequest)
+		log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+		return
+	}
+
+	ev := &audit.Event{
+		Action:   request.Action,
+		Repo:     request.Values.Repo,
+		Snapshot: request.Values.Snapshot,
+		Indices:  request.Values.Indices,
+		Index:    request.Values.Index,
+	}
+	if sc != nil {
+		ev.Cluster = sc.conf.Name
+	}
+	if auditedActions[request.Action] {
+		defer rt.auditRecord(r, sw, ev)
+	}
 	switch request.Action {
 	case "get_repositories":
 		{
-			response, err := rt.doGet(rt.conf.Snapshot.Host+"_cat/repositories?format=json", "Snapshot")
+			response, err := rt.doGet("_cat/repositories?format=json", sc.conf.Name)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -300,9 +452,38 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
 			w.Write(response)
 		}
+
+	case "get_repository":
+		{
+			if request.Values.Repo == "" {
+				msg := `{"error":"Required parameter Values.Repo is missed"}`
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+				return
+			}
+			detail, err := rt.repositoryDetail(sc, request.Values.Repo, request.Values.Verify, request.Values.Refresh)
+			if errors.Is(err, errRepositoryMissing) {
+				msg := `{"error":"Repository not found"}`
+				http.Error(w, msg, http.StatusNotFound)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusNotFound, "\t", msg)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
+				return
+			}
+			j, _ := json.Marshal(detail)
+			if detail.CatalogTime != nil {
+				w.Header().Set("X-Catalog-Time", detail.CatalogTime.Format(time.RFC3339))
+			}
+			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
+			w.Write(j)
+		}
+
 	case "get_nodes":
 		{
-			nresp, err := rt.getNodes()
+			nresp, err := rt.getNodes(sc.conf.Name)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -316,7 +497,7 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 
 	case "get_indices":
 		{
-			response, err := rt.doGet(rt.conf.Snapshot.Host+"extracted*/_recovery/", "Snapshot")
+			response, err := rt.doGet("extracted*/_recovery/", sc.conf.Name)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -334,7 +515,7 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
 				return
 			}
-			response, err := rt.doDel(rt.conf.Snapshot.Host+request.Values.Index, "Snapshot")
+			response, err := rt.doDel(request.Values.Index, sc.conf.Name)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -344,7 +525,46 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write(response)
 		}
 
-	case "get_snapshots":
+	case "find_index":
+		{
+			if request.Values.Index == "" {
+				msg := `{"error":"Required parameter Values.Index is missed"}`
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+				return
+			}
+
+			cluster := ""
+			if request.Values.Cluster != "" {
+				c, err := rt.cl.get(request.Values.Cluster, config.RoleRestore)
+				if err != nil {
+					msg := fmt.Sprintf(`{"error":"%s"}`, err)
+					http.Error(w, msg, http.StatusBadRequest)
+					log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+					return
+				}
+				cluster = c.conf.Name
+			}
+
+			built := rt.catalog.Built()
+			if built.IsZero() {
+				msg := `{"error":"The snapshot catalog is not built yet, try again later"}`
+				http.Error(w, msg, http.StatusServiceUnavailable)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusServiceUnavailable, "\t", msg)
+				return
+			}
+
+			j, _ := json.Marshal(findIndexResponse{
+				BuiltAt:     built,
+				CatalogTime: rt.catalog.Freshness(cluster),
+				Matches:     rt.catalog.Find(cluster, request.Values.Index),
+			})
+			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
+			w.Write(j)
+		}
+
+	// get_snapshots_sorted остался для старых клиентов, список берется из кэша так же
+	case "get_snapshots", "get_snapshots_sorted":
 		{
 			if request.Values.Repo == "" {
 				msg := `{"error":"Required parameter Values.Repo is missed"}`
@@ -353,131 +573,41 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			response, err := rt.doGet(rt.conf.Snapshot.Host+"_snapshot/"+request.Values.Repo+"/*?verbose=false&format=json", "Snapshot")
+			f, err := newSnapFilter(&request)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
+				msg := `{"error":"` + err.Error() + `"}`
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
 				return
 			}
 
-			var snap_resp snapResponse
-			var snap_items []snapItem
-			err = json.Unmarshal(response, &snap_resp)
+			page, err := rt.snapshotPage(sc, request.Values.Repo, f)
+			if errors.Is(err, errSnapCursor) {
+				msg := `{"error":"` + err.Error() + `"}`
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
 				return
 			}
-			re := regexp.MustCompile(`^(.*)-(\d{4}\.\d{2}\.\d{2})`)
 
-			if !rt.conf.Snapshot.Include {
-				for _, n := range snap_resp.Snapshots {
-					matched, err := regexp.MatchString(`^[\.]\S+`, n.Snapshot)
-					if err != nil {
-						log.Println("Regex error for ", n.Snapshot)
-					}
-					if !matched {
-						match := re.FindStringSubmatch(n.Snapshot)
-                        if len(match) < 3 {
-                            log.Println("Skip snapshot with unexpected name:", n.Snapshot)
-                            continue
-                        }
-						n.CreateDate = match[2]
-						d, err := time.Parse("2006.01.02", n.CreateDate)
-						n.CreateEpoch = d.Unix()
-						if err != nil {
-							http.Error(w, err.Error(), http.StatusInternalServerError)
-							log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
-							return
-						}
-						snap_items = append(snap_items, n)
-					}
-				}
-			} else {
-				for _, n := range snap_resp.Snapshots {
-					match := re.FindStringSubmatch(n.Snapshot)
-					if len(match) < 3 {
-						log.Println("Skip snapshot with unexpected name:", n.Snapshot)
-						continue
-					}
-					n.CreateDate = match[2]
-					d, err := time.Parse("2006.01.02", n.CreateDate)
-					n.CreateEpoch = d.Unix()
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
-						return
-					}
-					snap_items = append(snap_items, n)
-				}
+			if page.CatalogTime != nil {
+				w.Header().Set("X-Catalog-Time", page.CatalogTime.Format(time.RFC3339))
 			}
-
-			if request.Values.OrderType == "time" {
-
-				if request.Values.OrderDir == "asc" {
-					sort.Slice(snap_items[:], func(i, j int) bool {
-						return snap_items[i].CreateEpoch < snap_items[j].CreateEpoch
-					})
-				} else {
-					sort.Slice(snap_items[:], func(i, j int) bool {
-						return snap_items[i].CreateEpoch > snap_items[j].CreateEpoch
-					})
-				}
-
-			} else if request.Values.OrderType == "name" {
-
-				if request.Values.OrderDir == "asc" {
-					sort.Slice(snap_items[:], func(i, j int) bool {
-						return snap_items[i].Snapshot < snap_items[j].Snapshot
-					})
-
-				} else {
-					sort.Slice(snap_items[:], func(i, j int) bool {
-						return snap_items[i].Snapshot > snap_items[j].Snapshot
-					})
-				}
-
+			// без size отдаем весь список, как раньше
+			var j []byte
+			if f.size > 0 {
+				j, _ = json.Marshal(page)
+			} else {
+				j, _ = json.Marshal(page.Snapshots)
 			}
-			rt.sl = snap_items
-			j, _ := json.Marshal(snap_items)
 			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
 			w.Write(j)
 		}
 
-	case "get_snapshots_sorted":
-		{
-			if request.Values.OrderType == "time" {
-
-				if request.Values.OrderDir == "asc" {
-					sort.Slice(rt.sl[:], func(i, j int) bool {
-						return rt.sl[i].CreateEpoch < rt.sl[j].CreateEpoch
-					})
-				} else {
-					sort.Slice(rt.sl[:], func(i, j int) bool {
-						return rt.sl[i].CreateEpoch > rt.sl[j].CreateEpoch
-					})
-				}
-
-			} else if request.Values.OrderType == "name" {
-
-				if request.Values.OrderDir == "asc" {
-					sort.Slice(rt.sl[:], func(i, j int) bool {
-						return rt.sl[i].Snapshot < rt.sl[j].Snapshot
-					})
-
-				} else {
-					sort.Slice(rt.sl[:], func(i, j int) bool {
-						return rt.sl[i].Snapshot > rt.sl[j].Snapshot
-					})
-				}
-
-			}
-
-			j, _ := json.Marshal(rt.sl)
-			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", "Get Snapshots from cache")
-			w.Write(j)
-		}
-
 	case "get_snapshot":
 		{
 
@@ -495,14 +625,26 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			status_response, err := rt.doGet(rt.conf.Snapshot.Host+"_snapshot/"+request.Values.Repo+"/"+request.Values.Snapshot+"/_status", "Snapshot")
+			detail, err := rt.snapshotDetail(sc, request.Values.Repo, request.Values.Snapshot, request.Values.Refresh)
+			if errors.Is(err, errSnapshotMissing) {
+				msg := `{"error":"Snapshot not found"}`
+				http.Error(w, msg, http.StatusNotFound)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusNotFound, "\t", msg)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
 				return
 			}
-			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
-			w.Write(status_response)
+			j, _ := json.Marshal(detail)
+			if detail.CatalogTime != nil {
+				w.Header().Set("X-Catalog-Time", detail.CatalogTime.Format(time.RFC3339))
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", "from catalog")
+			} else {
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
+			}
+			w.Write(j)
 		}
 
 	case "restore":
@@ -521,72 +663,35 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			status_response, err := rt.doGet(rt.conf.Snapshot.Host+"_snapshot/"+request.Values.Repo+"/"+request.Values.Snapshot+"/_status", "Snapshot")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
-				return
-			}
-			var snap_status snapStatus
-			err = json.Unmarshal(status_response, &snap_status)
+			indices := make(IndicesInSnap)
+			err := rt.snapshotShards(sc, request.Values.Repo, request.Values.Snapshot, request.Values.Indices, indices)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
 				return
 			}
 
-			ch_response, err := rt.doGet(rt.conf.Snapshot.Host+"_cluster/health/extracted*", "Snapshot")
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t_cluster/health/extracted*\t", http.StatusInternalServerError, "\t", err.Error())
-				return
-			}
-			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t_cluster/health/extracted*\t", r.UserAgent())
-
-			var ch_status ClusterHealth
-			err = json.Unmarshal(ch_response, &ch_status)
-
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t_cluster/health/extracted*\t", http.StatusInternalServerError, "\t", err.Error())
+			if err := rt.checkRestoreHealth(sc); err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, errRestoreBusy) {
+					code = http.StatusTooManyRequests
+				}
+				msg := fmt.Sprintf(`{"error":"%s"}`, err)
+				http.Error(w, msg, code)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", code, "\t", msg)
 				return
 			}
 
-			// Если в кластере есть недовосстановленные индексы - прерываем
-			if ch_status.InitializingShards > 5 || ch_status.UnassignedShards > 5 {
-				msg := `{"error":"Indices will not be restored at now. Please wait"}`
-				http.Error(w, msg, http.StatusTooManyRequests)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusTooManyRequests, "\t", msg)
+			index_list_for_restore, index_list_not_restore := rt.Barrel(sc, indices)
+			ev.Indices = index_list_for_restore
+			if len(index_list_for_restore) == 0 {
+				msg := fmt.Sprintf(`{"error":"Indices '%v' will not be restored: Not enough space"}`, index_list_not_restore)
+				http.Error(w, msg, http.StatusInsufficientStorage)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInsufficientStorage, "\t", msg)
 				return
 			}
 
-			indices := make(IndicesInSnap)
-
-			for _, iname := range request.Values.Indices {
-				ind := snap_status.Snapshots[0].Indices[iname]
-				indices[iname] = &IndexInSnap{}
-				indices[iname].Size = ind.Stats.Total.Size
-				if ind.ShardsStats.Total > 0 {
-					for s := range snap_status.Snapshots[0].Indices[iname].Shards {
-						indices[iname].Shards = append(indices[iname].Shards, snap_status.Snapshots[0].Indices[iname].Shards[s].Stats.Total.Size)
-					}
-				}
-			}
-
-			index_list_for_restore, index_list_not_restore := rt.Barrel(indices, rt.conf.Snapshot.IsS3)
-
-			t := time.Now()
-			req := map[string]interface{}{
-				"ignore_unavailable":   false,
-				"include_global_state": false,
-				"include_aliases":      false,
-				"rename_pattern":       "(.+)",
-				"rename_replacement":   fmt.Sprintf("extracted_$1-%s", t.Format("02-01-2006")),
-				"indices":              index_list_for_restore,
-				"index_settings":       map[string]interface{}{"index.number_of_replicas": 0},
-			}
-
-			response, err := rt.doPost(rt.conf.Snapshot.Host+"_snapshot/"+request.Values.Repo+"/"+request.Values.Snapshot+"/_restore?wait_for_completion=false", req, "Snapshot")
+			response, err := rt.submitRestore(sc, request.Values.Repo, request.Values.Snapshot, index_list_for_restore, request.Values.Partial)
 			if err != nil {
 				msg := fmt.Sprintf(`{"error":"%s"}`, err)
 				http.Error(w, msg, 500)
@@ -594,11 +699,6 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			if len(index_list_not_restore) > 0 {
-				msg := fmt.Sprintf(`{"message":"Indices '%v' will not be restored: Not enough space", "error":1}`, index_list_not_restore)
-				w.Write([]byte(msg))
-			}
-
 			/*  Не создаем паттерны для восстановленных индексов
 			for _, iname := range index_list_for_restore {
 				if strings.Contains(iname, "v3") {
@@ -608,7 +708,7 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 							"title":         "extracted_v3-*",
 							"timeFieldName": "timestamp"}}
 
-					ip_resp, err := rt.doPost(rt.conf.Snapshot.Host+".kibana/_doc/index-pattern:v3-080", ip_req, "Snapshot")
+					ip_resp, err := rt.doPost(".kibana/_doc/index-pattern:v3-080", ip_req, sc.conf.Name)
 					if err != nil {
 						msg := fmt.Sprintf(`{"error":"%s"}`, err)
 						http.Error(w, msg, 500)
@@ -621,7 +721,7 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 							"title":         "extracted_*",
 							"timeFieldName": "@timestamp"}}
 
-					ip_resp, err := rt.doPost(rt.conf.Snapshot.Host+".kibana/_doc/index-pattern:080", ip_req, "Snapshot")
+					ip_resp, err := rt.doPost(".kibana/_doc/index-pattern:080", ip_req, sc.conf.Name)
 					if err != nil {
 						msg := fmt.Sprintf(`{"error":"%s"}`, err)
 						http.Error(w, msg, 500)
@@ -632,24 +732,140 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			*/
 
-			msg := fmt.Sprintf(`{"message":"Indices '%v' will be restored", "error":0}`, index_list_for_restore)
+			resp := restoreResponse{
+				Message:     fmt.Sprintf("Indices '%v' will be restored", index_list_for_restore),
+				Restored:    index_list_for_restore,
+				NotRestored: index_list_not_restore,
+			}
+			if request.Values.Partial {
+				resp.Message += ", shards missing in the snapshot will be empty"
+			}
+			if len(index_list_not_restore) > 0 {
+				resp.Message += fmt.Sprintf("; indices '%v' will not be restored: Not enough space", index_list_not_restore)
+				resp.Error = 1
+			}
+			j, _ := json.Marshal(resp)
 			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
-			w.Write([]byte(msg))
+			w.Write(j)
 
 		}
+	case "restore_range":
+		{
+			if request.Values.Index == "" {
+				msg := `{"error":"Required parameter Values.Index is missed"}`
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+				return
+			}
+
+			if request.Values.DateFrom == "" || request.Values.DateTo == "" {
+				msg := `{"error":"Required parameters Values.DateFrom and Values.DateTo are missed"}`
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+				return
+			}
+
+			// берем только успешные снапшоты, с partial - и частичные
+			request.Values.State = "SUCCESS"
+			if request.Values.Partial {
+				request.Values.State = "SUCCESS,PARTIAL"
+			}
+			f, err := newSnapFilter(&request)
+			if err != nil {
+				msg := `{"error":"` + err.Error() + `"}`
+				http.Error(w, msg, http.StatusBadRequest)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusBadRequest, "\t", msg)
+				return
+			}
+
+			repos := []string{request.Values.Repo}
+			if request.Values.Repo == "" {
+				repos, err = rt.repositories(sc.conf.Name)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
+					return
+				}
+			}
+
+			resp, err := rt.restoreRange(sc, repos, request.Values.Index, f, request.Values.Partial)
+			if err != nil {
+				code := http.StatusInternalServerError
+				if errors.Is(err, errRestoreBusy) {
+					code = http.StatusTooManyRequests
+				}
+				msg := fmt.Sprintf(`{"error":"%s"}`, err)
+				http.Error(w, msg, code)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", code, "\t", msg)
+				return
+			}
+			if len(resp.Restores) == 0 {
+				msg := `{"error":"No indices match Values.Index in the snapshots of the range"}`
+				http.Error(w, msg, http.StatusNotFound)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusNotFound, "\t", msg)
+				return
+			}
+
+			var snaps []string
+			ev.Indices = nil
+			for _, rr := range resp.Restores {
+				if rr.Status == "started" {
+					snaps = append(snaps, rr.Repo+"/"+rr.Snapshot)
+					ev.Indices = append(ev.Indices, rr.Indices...)
+				}
+			}
+			ev.Snapshot = strings.Join(snaps, ",")
+
+			j, _ := json.Marshal(resp)
+			if resp.Status == "failed" {
+				http.Error(w, string(j), http.StatusInternalServerError)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", resp.Message)
+				return
+			}
+			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", resp.Message)
+			w.Write(j)
+		}
+
+	case "restore_report":
+		{
+			pattern := request.Values.Index
+			if pattern == "" {
+				pattern = "extracted*"
+			}
+			timefield := request.Values.TimeField
+			if timefield == "" {
+				timefield = "@timestamp"
+			}
+			resp, err := rt.restoreReport(sc, pattern, timefield)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
+				return
+			}
+			j, _ := json.Marshal(resp)
+			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
+			w.Write(j)
+		}
+
 		/*  ---- search --- */
 	case "get_clusters":
 		{
 			var cl []Cluster
-			cl = append(cl, Cluster{rt.conf.Snapshot.Name, rt.conf.Snapshot.Host, "Snapshot"})
-			cl = append(cl, Cluster{rt.conf.Search.Name, rt.conf.Search.Host, "Search"})
+			for _, c := range rt.cl.all() {
+				ctype := "Snapshot"
+				if c.conf.CanSearch() {
+					ctype = "Search"
+				}
+				info := c.clusterInfo()
+				cl = append(cl, Cluster{c.conf.Name, c.conf.Host, ctype, c.conf.Roles, info.Distribution, info.Version, c.supportedFeatures()})
+			}
 			j, _ := json.Marshal(cl)
 			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent())
 			w.Write(j)
 		}
 	case "get_index_groups":
 		{
-			response, err := rt.getIndexGroups(request.Search.Cluster)
+			response, err := rt.getIndexGroups(sc.conf.Name)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -666,15 +882,9 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 			var (
 				fullm map[string]interface{}
 				m     map[string]interface{}
-				host  string
 			)
-			if request.Search.Cluster == "Snapshot" {
-				host = rt.conf.Snapshot.Host
-			} else if request.Search.Cluster == "Search" {
-				host = rt.conf.Search.Host
-			}
 			flatMap := make(map[string]string)
-			response, err := rt.doGet(host+request.Search.Index+"*"+t.Format("2006.01.02")+"*,"+request.Search.Index+"*"+t.Format("02-01-2006")+"*/_mapping", "Search")
+			response, err := rt.doGet(request.Search.Index+"*"+t.Format("2006.01.02")+"*,"+request.Search.Index+"*"+t.Format("02-01-2006")+"*/_mapping", sc.conf.Name)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -696,7 +906,7 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			j, _ := json.Marshal(flatMap)
-			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", host+request.Search.Index)
+			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", sc.conf.Host+request.Search.Index)
 			w.Write(j)
 		}
 
@@ -714,13 +924,7 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 				tf         string
 				fields     string
 				req        map[string]interface{}
-				host       string
 			)
-			if request.Search.Cluster == "Snapshot" {
-				host = rt.conf.Snapshot.Host
-			} else if request.Search.Cluster == "Search" {
-				host = rt.conf.Search.Host
-			}
 
 			ds, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateStart+" (MSK)")
 			de, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateEnd+" (MSK)")
@@ -765,10 +969,16 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 			query = fmt.Sprintf(`"query": { "bool": { "must": [ %s ],"filter": [  %s  %s ], "should": [],"must_not": [ %s ] }}`, xql, tf, filters, must_not)
 
 			full_query = fmt.Sprintf(`{"size": 500, %s, %s, %s, %s }`, sort, use_source, fields, query)
+			if sc.supports(featureTrackTotalHits) == nil {
+				full_query = fmt.Sprintf(`{"track_total_hits": true, %s`, full_query[1:])
+			}
+			ev.Index = request.Search.Index
+			ev.Query = full_query
 			if request.Search.Count {
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", host+request.Search.Index, "\t", "action: Count", "\tquery: ", "{"+query+"}")
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", sc.conf.Host+request.Search.Index, "\t", "action: Count", "\tquery: ", "{"+query+"}")
+				ev.Query = "{" + query + "}"
 				_ = json.Unmarshal([]byte("{"+query+"}"), &req)
-				cresponse, err := rt.doPost(host+request.Search.Index+"/_count", req, "Search")
+				cresponse, err := rt.doPost(request.Search.Index+"/_count", req, sc.conf.Name)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -777,9 +987,9 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 
 				w.Write(cresponse)
 			} else {
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", host+request.Search.Index, "\t", "action: Search", "\tquery: ", full_query)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", sc.conf.Host+request.Search.Index, "\t", "action: Search", "\tquery: ", full_query)
 				_ = json.Unmarshal([]byte(full_query), &req)
-				sresponse, err := rt.doPost(host+request.Search.Index+"/_search", req, "Search")
+				sresponse, err := rt.doPost(request.Search.Index+"/_search", req, sc.conf.Name)
 				if err != nil {
 					http.Error(w, err.Error(), http.StatusInternalServerError)
 					log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
@@ -792,249 +1002,35 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 
 	case "prepare_csv":
 		{
-			//allocateSpaceForFile("/tmp/data/"+request.Search.Fname+".csv", 100)
-			var (
-				use_source     string
-				query          string
-				filters        string
-				must_not       string
-				xql            string
-				full_query     string
-				timefield      string
-				sort           string
-				tf             string
-				fields         string
-				req            map[string]interface{}
-				scrollresponse scrollResponse
-				fields_list    []string
-				host           string
-				request_batch  int64
-			)
-
-			request_batch = rt.conf.Search.RequestBatch
-
-			if request.Search.Cluster == "Snapshot" {
-				host = rt.conf.Snapshot.Host
-			} else if request.Search.Cluster == "Search" {
-				host = rt.conf.Search.Host
-			}
-
-			ds, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateStart+" (MSK)")
-			de, _ := time.Parse("2006-01-02 15:04:05 (MST)", request.Search.DateEnd+" (MSK)")
-
-			if len(request.Search.Fields) == 0 {
-				use_source = `"_source": true`
-				fields_list = request.Search.Mapping
-			} else {
-				use_source = `"_source": false`
-				fields_list = request.Search.Fields
-			}
-
-			for _, f := range request.Search.Filters {
-
-				if f.Operation == "is" {
-					filters += `{ "match_phrase": {"` + f.Field + `":"` + f.Value + `" } },`
-				} else if f.Operation == "exists" {
-					filters += `{ "exists": {"field":"` + f.Field + `" } },`
-				} else if f.Operation == "is_not" {
-					must_not += `{ "match_phrase": {"` + f.Field + `":"` + f.Value + `" } },`
-				} else if f.Operation == "does_not_exists" {
-					must_not += `{ "exists": {"field":"` + f.Field + `" } },`
-				}
-			}
-			filters += `{"match_all": {}}`
-			must_not, _ = strings.CutSuffix(must_not, ",")
-
-			if request.Search.Xql != "" {
-				xql = `{ "simple_query_string": { "query": "` + request.Search.Xql + `" } }`
-			}
-			if len(request.Search.Timefields) > 0 {
-				timefield = request.Search.Timefields[0]
-				fields = `"fields": ["` + timefield + `", "` + strings.Join(request.Search.Fields, "\", \"") + `" ]`
-				sort = `"sort": [ {"` + timefield + `": "desc" } ]`
-				tf = `{ "range": { "` + timefield + `": {
-						   "gte": "` + ds.Format("2006-01-02T15:04:05.000Z") + `",
-						   "lte": "` + de.Format("2006-01-02T15:04:05.000Z") + `",
-						   "format": "strict_date_optional_time" } } },`
-			} else {
-				sort = ""
-				tf = ""
-				fields = `"fields": ["` + strings.Join(request.Search.Fields, "\", \"") + `" ]`
-			}
-			query = fmt.Sprintf(`"query": { "bool": { "must": [ %s ],"filter": [  %s  %s ], "should": [],"must_not": [ %s ] }}`, xql, tf, filters, must_not)
-
-			full_query = fmt.Sprintf(`{"size": %d, %s, %s, %s, %s }`, request_batch, sort, use_source, fields, query)
-
-			err = json.Unmarshal([]byte(full_query), &req)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
-				return
-			}
-			sresponse, err := rt.doPost(host+request.Search.Index+"/_search?scroll=10m", req, "Search")
+			ev.Index = request.Search.Index
+			ev.File = request.Search.Fname + ".csv"
+			defer observeExport("csv", time.Now(), ev)
+			err := rt.saveHintsToCsvFile(request, ev)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
-				return
-			}
-
-			f, err := os.OpenFile("/tmp/data/"+request.Search.Fname+".csv", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Fatal(err)
-			}
-			defer f.Close()
-
-			if len(request.Search.Timefields) > 0 {
-				f.WriteString(request.Search.Timefields[0] + `;` + strings.Join(fields_list, ";") + "\n")
-			} else {
-				f.WriteString(strings.Join(fields_list, ";") + "\n")
-			}
-
-			err = json.Unmarshal(sresponse, &scrollresponse)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
-				return
-			}
-
-			if len(scrollresponse.HitsRoot.Hits) > 0 {
-				var data any
-				for _, row := range scrollresponse.HitsRoot.Hits {
-					fileInfo, err := os.Stat("/tmp/data/" + request.Search.Fname + ".csv")
-					if err != nil {
-						log.Println(err)
-						return
-					}
-
-					if fileInfo.Size() > rt.conf.Search.FileLimit.Size {
-						return
-					}
-					if len(request.Search.Fields) == 0 {
-						f.WriteString(fmt.Sprintf("%v;", row.Source[request.Search.Timefields[0]]))
-					} else {
-						f.WriteString(fmt.Sprintf("%v;", row.Fields[request.Search.Timefields[0]]))
-					}
-					for _, fm := range fields_list {
-						if len(request.Search.Fields) == 0 {
-							data = row.Source[fm]
-						} else {
-							data = row.Fields[fm]
-						}
-
-						if data == nil {
-							f.WriteString(fmt.Sprintf("%s;", "--"))
-						} else {
-							switch reflect.TypeOf(data).Kind() {
-							case reflect.Slice:
-								{
-									s := reflect.ValueOf(data)
-									var ss string
-									for i := 0; i < s.Len(); i++ {
-										ss = ss + fmt.Sprintf("%v, ", s.Index(i))
-									}
-									ss = strings.TrimSuffix(ss, ", ")
-									ss = strings.Replace(ss, "\n", "", -1)
-									ss = strings.Replace(ss, "\"", "\"\"", -1)
-									f.WriteString(fmt.Sprintf(`"%s";`, ss))
-
-								}
-							case reflect.String:
-								{
-									f.WriteString(fmt.Sprintf(`"%v";`, strings.Replace(strings.Replace(data.(string), "\n", "", -1), "\"", "\"\"", -1)))
-								}
-							default:
-								{
-									f.WriteString(fmt.Sprintf("%v;", data))
-								}
-							}
-
-						}
-
-					}
-					f.WriteString("\n")
-				}
-			}
-
-			if scrollresponse.ScrollID != "" {
-				scroll := map[string]interface{}{"scroll": "10m", "scroll_id": scrollresponse.ScrollID}
-				for i := 0; i < rt.conf.Search.FileLimit.Rows/10000; i++ {
-					sresponse, err := rt.doPost(host+"_search/scroll", scroll, "Search")
-					if err != nil {
-						log.Println("Failed to get scroll batch: ", err)
-						return
-					}
-					_ = json.Unmarshal(sresponse, &scrollresponse)
-					if len(scrollresponse.HitsRoot.Hits) == 0 {
-						_, _ = rt.doDel(request.Search.Cluster+"_search/scroll/"+scrollresponse.ScrollID, "Search")
-						break
-					}
-					if len(scrollresponse.HitsRoot.Hits) > 0 {
-
-						var data any
-						for _, row := range scrollresponse.HitsRoot.Hits {
-							fileInfo, err := os.Stat("/tmp/data/" + request.Search.Fname + ".csv")
-							if err != nil {
-								log.Println(err)
-								return
-							}
-							if fileInfo.Size() > rt.conf.Search.FileLimit.Size {
-								return
-							}
-
-							if len(request.Search.Fields) == 0 {
-								f.WriteString(fmt.Sprintf("%v;", row.Source[request.Search.Timefields[0]]))
-							} else {
-								f.WriteString(fmt.Sprintf("%v;", row.Fields[request.Search.Timefields[0]]))
-							}
-							for _, fm := range fields_list {
-								if len(request.Search.Fields) == 0 {
-									data = row.Source[fm]
-								} else {
-									data = row.Fields[fm]
-								}
-
-								if data == nil {
-									f.WriteString(fmt.Sprintf("%s;", "--"))
-								} else {
-									switch reflect.TypeOf(data).Kind() {
-									case reflect.Slice:
-										{
-											s := reflect.ValueOf(data)
-											var ss string
-											for i := 0; i < s.Len(); i++ {
-												ss = ss + fmt.Sprintf("%v, ", s.Index(i))
-											}
-											ss = strings.TrimSuffix(ss, ", ")
-											ss = strings.Replace(ss, "\n", "", -1)
-											ss = strings.Replace(ss, "\"", "\"\"", -1)
-											f.WriteString(fmt.Sprintf(`"%s";`, ss))
-										}
-									case reflect.String:
-										{
-											f.WriteString(fmt.Sprintf(`"%v";`, strings.Replace(strings.Replace(data.(string), "\n", "", -1), "\"", "\"\"", -1)))
-										}
-									default:
-										{
-											f.WriteString(fmt.Sprintf("%v;", data))
-										}
-									}
-								}
-							}
-							f.WriteString("\n")
-						}
-					}
+				code := http.StatusInternalServerError
+				if errors.Is(err, errShuttingDown) {
+					code = http.StatusServiceUnavailable
 				}
-
+				http.Error(w, err.Error(), code)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", code, "\t", err.Error())
+				return
 			}
-			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", host+request.Search.Index, "\t", "action: CSV", "\tquery: ", full_query, "\tfile: ", request.Search.Fname)
+			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", r.UserAgent(), "\t", request.Search.Index, "\t", "action: CSV", "\tquery: ", ev.Query, "\tfile: ", request.Search.Fname)
 			w.Write([]byte("Done"))
 		}
 	case "prepare_json":
 		{
-			err := rt.saveHintsToJsonFile(request)
+			ev.Index = request.Search.Index
+			ev.File = request.Search.Fname + ".json"
+			defer observeExport("json", time.Now(), ev)
+			err := rt.saveHintsToJsonFile(request, ev)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", http.StatusInternalServerError, "\t", err.Error())
+				code := http.StatusInternalServerError
+				if errors.Is(err, errShuttingDown) {
+					code = http.StatusServiceUnavailable
+				}
+				http.Error(w, err.Error(), code)
+				log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", request.Action, "\t", code, "\t", err.Error())
 				return
 			}
 
@@ -1045,6 +1041,7 @@ func (rt *Router) ApiHandler(w http.ResponseWriter, r *http.Request) {
 
 	default:
 		{
+			request.Action = "unknown"
 			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 			log.Println(remoteIP, "\t", r.Method, "\t", r.URL.Path, "\t", http.StatusServiceUnavailable, "\t", "Invalid request method ")
 			return
@@ -0,0 +1,116 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	errInterrupted  = errors.New("export interrupted by shutdown, file is incomplete")
+	errShuttingDown = errors.New("server is shutting down, export is not started")
+)
+
+// jobGroup counts the running exports. Once shutdown starts it refuses new ones,
+// so a job is never added while serve is already waiting for the running ones
+type jobGroup struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	stopping bool
+}
+
+func (g *jobGroup) start() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopping {
+		return false
+	}
+	g.wg.Add(1)
+	return true
+}
+
+func (g *jobGroup) done() {
+	g.wg.Done()
+}
+
+// stop refuses new jobs and returns a channel closed when the running ones are done
+func (g *jobGroup) stop() <-chan struct{} {
+	g.mu.Lock()
+	g.stopping = true
+	g.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func (rt *Router) stopping() bool {
+	select {
+	case <-rt.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// markIncomplete renames an unfinished export so it is never mistaken for a complete one
+func markIncomplete(filePath string) {
+	if err := os.Rename(filePath, filePath+".incomplete"); err != nil {
+		log.Println("Cannot mark export as incomplete:", err)
+	}
+}
+
+func (rt *Router) clearScroll(cluster, scrollId string) {
+	if scrollId == "" {
+		return
+	}
+	_, err := rt.doDel("_search/scroll/"+scrollId, cluster)
+	if err != nil {
+		log.Println("Failed to clear scroll context: ", err)
+	}
+}
+
+// serve runs the server until SIGINT/SIGTERM/SIGQUIT, then stops accepting requests,
+// waits up to app.shutdown_timeout for running handlers and interrupts unfinished exports,
+// cancelling their pending Elasticsearch requests; they get app.shutdown_timeout more to clean up
+func (rt *Router) serve(srv *http.Server, listen func() error) {
+	go func() {
+		if err := listen(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("cannot start server: %s\n", err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	s := <-sig
+	log.Println("Shutdown: got signal", s)
+	rt.ready.down.Store(true)
+	done := rt.jobs.stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rt.config().App.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Shutdown: deadline exceeded, interrupting running exports")
+	}
+	rt.stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Duration(rt.config().App.ShutdownTimeout) * time.Second):
+		log.Println("Shutdown: exports did not stop in time")
+	}
+	// события аудита из очереди индекса отправляются до выхода
+	rt.auditLogger().Close()
+	if err := rt.catalog.Close(); err != nil {
+		log.Println("Shutdown: cannot close the catalog:", err)
+	}
+	log.Println("Shutdown: done")
+}
@@ -0,0 +1,28 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobGroup(t *testing.T) {
+	var g jobGroup
+	if !g.start() {
+		t.Fatal("job refused before shutdown")
+	}
+	done := g.stop()
+	if g.start() {
+		t.Fatal("job started after shutdown")
+	}
+	select {
+	case <-done:
+		t.Fatal("stop did not wait for the running job")
+	case <-time.After(10 * time.Millisecond):
+	}
+	g.done()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stop did not finish after the job was done")
+	}
+}
@@ -0,0 +1,77 @@
+package router
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type snapKey struct {
+	cluster string
+	repo    string
+}
+
+type snapEntry struct {
+	items  []snapItem
+	loaded time.Time
+}
+
+// snapCache keeps the full snapshot list of each repository, so sorting and paging
+// do not read it from the cluster again. Callers only ever get copies of the lists.
+type snapCache struct {
+	sync.Mutex
+	entries map[snapKey]snapEntry
+}
+
+func (sc *snapCache) get(k snapKey, ttl time.Duration) ([]snapItem, bool) {
+	sc.Lock()
+	defer sc.Unlock()
+	e, ok := sc.entries[k]
+	if !ok || time.Since(e.loaded) > ttl {
+		return nil, false
+	}
+	return slices.Clone(e.items), true
+}
+
+// put stores the list and drops the expired ones of other repositories
+func (sc *snapCache) put(k snapKey, items []snapItem, ttl time.Duration) {
+	sc.Lock()
+	defer sc.Unlock()
+	if sc.entries == nil {
+		sc.entries = make(map[snapKey]snapEntry)
+	}
+	for key, e := range sc.entries {
+		if time.Since(e.loaded) > ttl {
+			delete(sc.entries, key)
+		}
+	}
+	sc.entries[k] = snapEntry{items: slices.Clone(items), loaded: time.Now()}
+}
+
+func (sc *snapCache) dropCluster(name string) {
+	sc.Lock()
+	defer sc.Unlock()
+	for key := range sc.entries {
+		if key.cluster == name {
+			delete(sc.entries, key)
+		}
+	}
+}
+
+// cachedSnapshots returns a copy of the full snapshot list of the repository. It is read
+// from the cluster when the cached one is older than app.snapshot_cache_ttl or on refresh.
+func (rt *Router) cachedSnapshots(c *esCluster, repo string, refresh bool) ([]snapItem, error) {
+	k := snapKey{cluster: c.conf.Name, repo: repo}
+	ttl := time.Duration(rt.config().App.SnapshotCache) * time.Second
+	if !refresh {
+		if items, ok := rt.snaps.get(k, ttl); ok {
+			return items, nil
+		}
+	}
+	items, err := rt.listSnapshots(c, repo, "*")
+	if err != nil {
+		return nil, err
+	}
+	rt.snaps.put(k, items, ttl)
+	return items, nil
+}
@@ -0,0 +1,162 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errSnapshotMissing = errors.New("snapshot not found")
+
+// snapshotIndex is an index of the snapshot as get_snapshot returns it
+type snapshotIndex struct {
+	Index     string   `json:"index"`
+	Size      int64    `json:"size_in_bytes"`
+	Shards    int      `json:"shards"`
+	Docs      *int64   `json:"docs,omitempty"`
+	DataDate  string   `json:"data_date,omitempty"`
+	Extracted []string `json:"extracted,omitempty"`
+	Fits      *bool    `json:"fits"` // null - место не проверялось
+	shards    []int
+}
+
+type snapshotDetail struct {
+	Repository  string          `json:"repository"`
+	Snapshot    string          `json:"snapshot"`
+	State       string          `json:"state"`
+	Indices     []snapshotIndex `json:"indices"`
+	CatalogTime *time.Time      `json:"catalog_time,omitempty"`
+}
+
+// extractedCopy is an index restored by the extractor: extracted_<index>-<dd-mm-yyyy>
+type extractedCopy struct {
+	name string
+	docs *int64
+}
+
+// snapshotDetail describes every index of the snapshot: from the catalog when it has the
+// snapshot and refresh is not asked for, otherwise from the snapshot status
+func (rt *Router) snapshotDetail(c *esCluster, repo, snapshot string, refresh bool) (snapshotDetail, error) {
+	d := snapshotDetail{Repository: repo, Snapshot: snapshot, Indices: []snapshotIndex{}}
+	fromCatalog := false
+	if !refresh {
+		// у снапшота, размеры которого каталог еще не прочитал, берем _status
+		if s, refreshed, ok := rt.catalog.Snapshot(c.conf.Name, repo, snapshot); ok && !s.Pending {
+			fromCatalog = true
+			d.State = s.State
+			d.CatalogTime = &refreshed
+			for _, idx := range s.Indices {
+				// в каталоге только общий размер индекса, размеров шардов для проверки места нет
+				d.Indices = append(d.Indices, snapshotIndex{Index: idx.Name, Size: idx.Size, Shards: idx.Shards})
+			}
+		}
+	}
+	if !fromCatalog {
+		response, err := rt.doGet("_snapshot/"+repo+"/"+snapshot+"/_status", c.conf.Name)
+		if err != nil {
+			return d, err
+		}
+		var status snapStatus
+		if err := json.Unmarshal(response, &status); err != nil {
+			return d, err
+		}
+		if len(status.Snapshots) == 0 {
+			return d, errSnapshotMissing
+		}
+		d.State = status.Snapshots[0].State
+		for name, idx := range status.Snapshots[0].Indices {
+			si := snapshotIndex{Index: name, Size: int64(idx.Stats.Total.Size), Shards: idx.ShardsStats.Total}
+			for _, sh := range idx.Shards {
+				si.shards = append(si.shards, sh.Stats.Total.Size)
+			}
+			d.Indices = append(d.Indices, si)
+		}
+	}
+	sort.Slice(d.Indices, func(i, j int) bool { return d.Indices[i].Index < d.Indices[j].Index })
+
+	copies, err := rt.extractedCopies(c)
+	if err != nil {
+		log.Printf("Cluster %s: cannot list extracted indices: %s\n", c.conf.Name, err)
+	}
+	for i := range d.Indices {
+		si := &d.Indices[i]
+		if t, ok := c.snapshotDate(si.Index); ok {
+			si.DataDate = t.Format("2006.01.02")
+		}
+		for _, cp := range copies[si.Index] {
+			si.Extracted = append(si.Extracted, cp.name)
+			if cp.docs != nil && (si.Docs == nil || *cp.docs > *si.Docs) {
+				si.Docs = cp.docs
+			}
+		}
+		if !fromCatalog {
+			fits := rt.indexFits(c, si)
+			si.Fits = &fits
+		}
+	}
+	return d, nil
+}
+
+// extractedSource returns the name of the original index of a restored copy,
+// extracted_<index>-02-01-2006
+func extractedSource(name string) (string, bool) {
+	name, ok := strings.CutPrefix(name, "extracted_")
+	if !ok || len(name) < 12 || name[len(name)-11] != '-' {
+		return "", false
+	}
+	if _, err := time.Parse("02-01-2006", name[len(name)-10:]); err != nil {
+		return "", false
+	}
+	return name[:len(name)-11], true
+}
+
+// extractedCopies lists the indices restored earlier by the index they were restored from
+func (rt *Router) extractedCopies(c *esCluster) (map[string][]extractedCopy, error) {
+	response, err := rt.doGet("_cat/indices/extracted_*?format=json&h=index,docs.count", c.conf.Name)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Index string `json:"index"`
+		Docs  string `json:"docs.count"`
+	}
+	if err := json.Unmarshal(response, &rows); err != nil {
+		return nil, err
+	}
+	copies := make(map[string][]extractedCopy)
+	for _, row := range rows {
+		orig, ok := extractedSource(row.Index)
+		if !ok {
+			continue
+		}
+		cp := extractedCopy{name: row.Index}
+		if n, err := strconv.ParseInt(row.Docs, 10, 64); err == nil {
+			cp.docs = &n
+		}
+		copies[orig] = append(copies[orig], cp)
+	}
+	for orig := range copies {
+		sort.Slice(copies[orig], func(i, j int) bool { return copies[orig][i].name < copies[orig][j].name })
+	}
+	return copies, nil
+}
+
+// indexFits runs the restore capacity check for the index alone
+func (rt *Router) indexFits(c *esCluster, si *snapshotIndex) bool {
+	ind := &IndexInSnap{Name: si.Index, Size: int(si.Size)}
+	for _, s := range si.shards {
+		// пустые шарды места не занимают
+		if s > 0 {
+			ind.Shards = append(ind.Shards, s)
+		}
+	}
+	if len(ind.Shards) == 0 {
+		return true
+	}
+	fit, _ := rt.Barrel(c, IndicesInSnap{si.Index: ind})
+	return len(fit) > 0
+}
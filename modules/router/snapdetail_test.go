@@ -0,0 +1,29 @@
+package router
+
+import "testing"
+
+func TestExtractedSource(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // пусто - не копия, восстановленная экстрактором
+	}{
+		{"extracted_logs-2024.03.15-18-10-2026", "logs-2024.03.15"},
+		{"extracted_audit-01-01-2026", "audit"},
+		{"extracted_a-b-c-01-12-2025", "a-b-c"},
+		{"extracted_x-31-12-2025", "x"},
+		{"extracted_logs-32-10-2026", ""},
+		{"extracted_logs-18-13-2026", ""},
+		{"extracted_logs-2026-10-18", ""},
+		{"extracted_logs_18-10-2026", ""},
+		{"extracted_-18-10-2026", ""},
+		{"extracted_18-10-2026", ""},
+		{"logs-18-10-2026", ""},
+		{"extracted_logs", ""},
+	}
+	for _, tt := range tests {
+		got, ok := extractedSource(tt.name)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("extractedSource(%q) = %q, %v, want %q", tt.name, got, ok, tt.want)
+		}
+	}
+}
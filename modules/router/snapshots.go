@@ -0,0 +1,398 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/catalog"
+	"github.com/flant/elasticsearch-extractor/modules/config"
+)
+
+type snapPattern struct {
+	name   string
+	re     *regexp.Regexp
+	layout string
+	group  int
+}
+
+func compileSnapPatterns(l []config.SnapshotPattern) ([]snapPattern, error) {
+	var res []snapPattern
+	for _, sp := range l {
+		re, err := regexp.Compile(sp.Regex)
+		if err != nil {
+			return nil, err
+		}
+		group := re.SubexpIndex("date")
+		if group < 0 {
+			group = re.NumSubexp()
+		}
+		res = append(res, snapPattern{name: sp.Name, re: re, layout: sp.Layout, group: group})
+	}
+	return res, nil
+}
+
+// snapshotDate takes the date from the snapshot name using the first pattern that matches
+func (c *esCluster) snapshotDate(name string) (time.Time, bool) {
+	for _, p := range c.snapPatterns {
+		match := p.re.FindStringSubmatch(name)
+		if len(match) <= p.group {
+			continue
+		}
+		d, err := time.Parse(p.layout, match[p.group])
+		if err != nil {
+			continue
+		}
+		return d, true
+	}
+	return time.Time{}, false
+}
+
+// snapshotItem converts the cluster response into the list entry; the snapshot date is the
+// real start time, the date found in the name by the snapshot patterns goes to DataDate
+func (c *esCluster) snapshotItem(n esSnapshot) snapItem {
+	item := snapItem{
+		Snapshot:    n.Snapshot,
+		Uuid:        n.Uuid,
+		State:       n.State,
+		StartTime:   n.StartTimeInMillis,
+		EndTime:     n.EndTimeInMillis,
+		Duration:    n.DurationInMillis,
+		IndexCount:  len(n.Indices),
+		ShardsTotal: n.Shards.Total,
+		ShardsOK:    n.Shards.Successful,
+		ShardsFail:  n.Shards.Failed,
+		Failures:    len(n.Failures),
+	}
+	for _, d := range n.IndexDetails {
+		item.Size += d.SizeInBytes
+	}
+	start := time.UnixMilli(n.StartTimeInMillis).UTC()
+	item.CreateEpoch = start.Unix()
+	item.CreateDate = start.Format("2006.01.02")
+	if d, ok := c.snapshotDate(n.Snapshot); ok {
+		item.DataDate = d.Format("2006.01.02")
+	}
+	return item
+}
+
+// snapFilter narrows get_snapshots: the name pattern is passed to the cluster, states and
+// the start date range are checked here; size and after select the page
+type snapFilter struct {
+	name    string
+	states  map[string]bool
+	from    int64 // start_time_in_millis, включительно
+	to      int64 // не включительно, 0 - без ограничения
+	size    int
+	after   string
+	otype   string
+	odir    string
+	refresh bool
+}
+
+var errSnapCursor = errors.New("invalid values.after cursor")
+
+type snapPage struct {
+	Snapshots   []snapItem `json:"snapshots"`
+	Next        string     `json:"next,omitempty"`
+	Total       int        `json:"total,omitempty"`
+	CatalogTime *time.Time `json:"catalog_time,omitempty"` // если список взят из каталога
+}
+
+func newSnapFilter(request *apiRequest) (snapFilter, error) {
+	v := request.Values
+	f := snapFilter{name: "*", size: v.Size, after: v.After, otype: v.OrderType, odir: v.OrderDir, refresh: v.Refresh}
+	if v.Name != "" {
+		f.name = v.Name
+	}
+	if f.size < 0 {
+		return f, fmt.Errorf("values.size must not be negative")
+	}
+	for _, st := range strings.Split(v.State, ",") {
+		st = strings.ToUpper(strings.TrimSpace(st))
+		if st == "" {
+			continue
+		}
+		if f.states == nil {
+			f.states = map[string]bool{}
+		}
+		f.states[st] = true
+	}
+	if v.DateFrom != "" {
+		d, err := time.Parse("2006-01-02", v.DateFrom)
+		if err != nil {
+			return f, fmt.Errorf("values.date_from must be YYYY-MM-DD")
+		}
+		f.from = d.UnixMilli()
+	}
+	if v.DateTo != "" {
+		d, err := time.Parse("2006-01-02", v.DateTo)
+		if err != nil {
+			return f, fmt.Errorf("values.date_to must be YYYY-MM-DD")
+		}
+		f.to = d.AddDate(0, 0, 1).UnixMilli()
+	}
+	return f, nil
+}
+
+func (f snapFilter) match(item snapItem) bool {
+	if f.states != nil && !f.states[item.State] {
+		return false
+	}
+	if item.StartTime < f.from {
+		return false
+	}
+	return f.to == 0 || item.StartTime < f.to
+}
+
+// fetchSnapshots reads the snapshots of the repository matching the name pattern with
+// their timing, shard counts and, where the cluster reports it cheaply from the repository
+// metadata, the size of every index
+func (rt *Router) fetchSnapshots(c *esCluster, repo, name string) ([]esSnapshot, error) {
+	path := "_snapshot/" + repo + "/" + url.PathEscape(name) + "?format=json"
+	if c.supports(featureSnapshotIndexDetails) == nil {
+		path += "&index_details=true"
+	}
+	response, err := rt.doGet(path, c.conf.Name)
+	if err != nil {
+		return nil, err
+	}
+	snap_resp, err := decodeSnapshots(response)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []esSnapshot
+	for _, n := range snap_resp.Snapshots {
+		if !c.hiddenSnapshot(n.Snapshot) {
+			res = append(res, n)
+		}
+	}
+	return res, nil
+}
+
+// listSnapshots returns the list entries of the snapshots matching the name pattern
+func (rt *Router) listSnapshots(c *esCluster, repo, name string) ([]snapItem, error) {
+	snaps, err := rt.fetchSnapshots(c, repo, name)
+	if err != nil {
+		return nil, err
+	}
+	var items []snapItem
+	for _, n := range snaps {
+		items = append(items, c.snapshotItem(n))
+	}
+	return items, nil
+}
+
+// системные снапшоты (.slm-history и т.п.) показываем только с include_system
+func (c *esCluster) hiddenSnapshot(name string) bool {
+	return !c.conf.Include && strings.HasPrefix(name, ".")
+}
+
+// nativeSnapshotSorts maps otype to the sort parameter of GET _snapshot; the other orders
+// are only possible on the full list
+var nativeSnapshotSorts = map[string]string{
+	"":         "",
+	"name":     "name",
+	"time":     "start_time",
+	"duration": "duration",
+	"indices":  "index_count",
+	"shards":   "shard_count",
+	"failed":   "failed_shard_count",
+}
+
+// snapshotPage returns one page of the filtered and sorted snapshot list. A repository
+// that is in the catalog is served from it, unless refresh is set. Otherwise clusters
+// with snapshot pagination page and sort on their side and the cursor is theirs, and
+// for the rest the whole list is filtered and sorted here and the cursor is the offset
+// in it. The list of the whole repository comes from the snapshot cache, narrower name
+// patterns are read from the cluster. Without size the page is the whole list.
+func (rt *Router) snapshotPage(c *esCluster, repo string, f snapFilter) (snapPage, error) {
+	var page snapPage
+	var items []snapItem
+	var err error
+	if !f.refresh {
+		var refreshed time.Time
+		var ok bool
+		items, refreshed, ok = rt.catalogSnapshots(c, repo)
+		if ok {
+			page.CatalogTime = &refreshed
+		}
+	}
+
+	switch esSort, native := nativeSnapshotSorts[f.otype]; {
+	case page.CatalogTime != nil:
+		// шаблон имени в каталоге проверяем сами
+		names := strings.Split(f.name, ",")
+		items = slices.DeleteFunc(items, func(item snapItem) bool { return !catalog.MatchName(names, item.Snapshot) })
+	case native && f.size > 0 && c.supports(featureSnapshotPagination) == nil:
+		return rt.snapshotPageNative(c, repo, f, esSort)
+	case f.name == "*":
+		items, err = rt.cachedSnapshots(c, repo, f.refresh)
+	default:
+		items, err = rt.listSnapshots(c, repo, f.name)
+	}
+	if err != nil {
+		return snapPage{}, err
+	}
+	for _, item := range items {
+		if f.match(item) {
+			page.Snapshots = append(page.Snapshots, item)
+		}
+	}
+	sortSnapshots(page.Snapshots, f.otype, f.odir)
+	page.Total = len(page.Snapshots)
+	if f.size == 0 {
+		return page, nil
+	}
+
+	offset := 0
+	if f.after != "" {
+		offset, err = strconv.Atoi(f.after)
+		if err != nil || offset < 0 {
+			return snapPage{}, errSnapCursor
+		}
+	}
+	offset = min(offset, page.Total)
+	end := min(offset+f.size, page.Total)
+	page.Snapshots = page.Snapshots[offset:end]
+	if end < page.Total {
+		page.Next = strconv.Itoa(end)
+	}
+	return page, nil
+}
+
+// snapshotPageRequests caps the requests one page of a filtered native listing may take
+const snapshotPageRequests = 10
+
+// snapshotPageNative fills the page from the cluster with size/after/sort. Every request asks
+// for a full page; snapshots dropped by the state and date filters are made up with further
+// requests, at most snapshotPageRequests, after which the page is returned short with
+// the cursor to continue. When a response has more matches than fit, the cursor is the one
+// of that response plus the number of its snapshots already taken: <after>~<skip>.
+// The total of the cluster is reported only when nothing is filtered here.
+func (rt *Router) snapshotPageNative(c *esCluster, repo string, f snapFilter, esSort string) (snapPage, error) {
+	order := "desc"
+	if f.odir == "asc" {
+		order = "asc"
+	}
+	var page snapPage
+	after, skip, err := parseNativeCursor(f.after)
+	if err != nil {
+		return snapPage{}, err
+	}
+	for i := 0; ; i++ {
+		path := "_snapshot/" + repo + "/" + url.PathEscape(f.name) + "?format=json&size=" + strconv.Itoa(f.size)
+		if esSort != "" {
+			path += "&sort=" + esSort + "&order=" + order
+		}
+		if after != "" {
+			path += "&after=" + url.QueryEscape(after)
+		}
+		if c.supports(featureSnapshotIndexDetails) == nil {
+			path += "&index_details=true"
+		}
+		response, err := rt.doGet(path, c.conf.Name)
+		if err != nil {
+			return snapPage{}, err
+		}
+		snap_resp, err := decodeSnapshots(response)
+		if err != nil {
+			return snapPage{}, err
+		}
+		if i == 0 {
+			page.Total = snap_resp.Total
+		}
+
+		for j := skip; j < len(snap_resp.Snapshots); j++ {
+			n := snap_resp.Snapshots[j]
+			item := c.snapshotItem(n)
+			if c.hiddenSnapshot(n.Snapshot) || !f.match(item) {
+				continue
+			}
+			page.Snapshots = append(page.Snapshots, item)
+			if len(page.Snapshots) == f.size {
+				if j+1 < len(snap_resp.Snapshots) {
+					page.Next = after + "~" + strconv.Itoa(j+1)
+				} else {
+					page.Next = snap_resp.Next
+				}
+				break
+			}
+		}
+		skip = 0
+		if len(page.Snapshots) == f.size {
+			break
+		}
+
+		after = snap_resp.Next
+		// по дате старта дальше совпадений уже не будет
+		if esSort == "start_time" && len(snap_resp.Snapshots) > 0 {
+			last := snap_resp.Snapshots[len(snap_resp.Snapshots)-1].StartTimeInMillis
+			if (order == "asc" && f.to != 0 && last >= f.to) || (order == "desc" && last < f.from) {
+				after = ""
+			}
+		}
+		if after == "" || i+1 >= snapshotPageRequests {
+			page.Next = after
+			break
+		}
+	}
+	if !c.conf.Include || f.states != nil || f.from != 0 || f.to != 0 {
+		page.Total = 0
+	}
+	return page, nil
+}
+
+// parseNativeCursor splits <after>~<skip>; a cursor of the cluster alone skips nothing
+func parseNativeCursor(cursor string) (string, int, error) {
+	i := strings.LastIndex(cursor, "~")
+	if i < 0 {
+		return cursor, 0, nil
+	}
+	skip, err := strconv.Atoi(cursor[i+1:])
+	if err != nil || skip < 0 {
+		return "", 0, errSnapCursor
+	}
+	return cursor[:i], skip, nil
+}
+
+var snapshotOrders = map[string]func(a, b snapItem) bool{
+	"name":     func(a, b snapItem) bool { return a.Snapshot < b.Snapshot },
+	"time":     func(a, b snapItem) bool { return a.StartTime < b.StartTime },
+	"end":      func(a, b snapItem) bool { return a.EndTime < b.EndTime },
+	"duration": func(a, b snapItem) bool { return a.Duration < b.Duration },
+	"size":     func(a, b snapItem) bool { return a.Size < b.Size },
+	"indices":  func(a, b snapItem) bool { return a.IndexCount < b.IndexCount },
+	"shards":   func(a, b snapItem) bool { return a.ShardsTotal < b.ShardsTotal },
+	"failed":   func(a, b snapItem) bool { return a.ShardsFail < b.ShardsFail },
+	"state":    func(a, b snapItem) bool { return a.State < b.State },
+}
+
+// sortSnapshots orders the list by otype (see snapshotOrders), ties are broken by start time;
+// an unknown otype keeps the order of the cluster
+func sortSnapshots(items []snapItem, otype, odir string) {
+	less, ok := snapshotOrders[otype]
+	if !ok {
+		return
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if odir != "asc" {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.StartTime < b.StartTime
+	})
+}
@@ -0,0 +1,122 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/config"
+)
+
+func TestSnapshotDate(t *testing.T) {
+	patterns, err := compileSnapPatterns([]config.SnapshotPattern{
+		{Name: "named", Regex: `^nightly-(?P<date>\d{8})-\d+$`, Layout: "20060102"},
+		{Name: "last group", Regex: `^(weekly)-(\d{4}-\d{2}-\d{2})$`, Layout: "2006-01-02"},
+		config.DefaultSnapshotPattern,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &esCluster{snapPatterns: patterns}
+
+	tests := []struct {
+		name string
+		want string // пусто - даты в имени нет
+	}{
+		{"logs-2024.03.15", "2024.03.15"},
+		{"logs-app-2024.03.15-1", "2024.03.15"},
+		{"nightly-20240315-2", "2024.03.15"},
+		{"weekly-2024-03-15", "2024.03.15"},
+		// шаблон совпал, но дата не разбирается
+		{"nightly-20241399-1", ""},
+		{"logs-2024.13.01", ""},
+		{"snapshot-1", ""},
+		{"2024.03.15", ""},
+	}
+	for _, tt := range tests {
+		d, ok := c.snapshotDate(tt.name)
+		got := ""
+		if ok {
+			got = d.Format("2006.01.02")
+		}
+		if got != tt.want {
+			t.Errorf("snapshotDate(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapFilterMatch(t *testing.T) {
+	day := func(s string) int64 {
+		d, _ := time.Parse("2006-01-02 15:04", s)
+		return d.UnixMilli()
+	}
+	tests := []struct {
+		name  string
+		state string
+		from  string
+		to    string
+		item  snapItem
+		want  bool
+	}{
+		{"no filter", "", "", "", snapItem{State: "FAILED", StartTime: day("2024-03-15 10:00")}, true},
+		{"state", "SUCCESS", "", "", snapItem{State: "SUCCESS"}, true},
+		{"state list", " success, partial ", "", "", snapItem{State: "PARTIAL"}, true},
+		{"other state", "SUCCESS,PARTIAL", "", "", snapItem{State: "FAILED"}, false},
+		{"from inclusive", "", "2024-03-15", "", snapItem{StartTime: day("2024-03-15 00:00")}, true},
+		{"before from", "", "2024-03-15", "", snapItem{StartTime: day("2024-03-14 23:59")}, false},
+		{"to inclusive", "", "", "2024-03-15", snapItem{StartTime: day("2024-03-15 23:59")}, true},
+		{"after to", "", "", "2024-03-15", snapItem{StartTime: day("2024-03-16 00:00")}, false},
+		{"one day", "SUCCESS", "2024-03-15", "2024-03-15", snapItem{State: "SUCCESS", StartTime: day("2024-03-15 12:00")}, true},
+	}
+	for _, tt := range tests {
+		var request apiRequest
+		request.Values.State, request.Values.DateFrom, request.Values.DateTo = tt.state, tt.from, tt.to
+		f, err := newSnapFilter(&request)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got := f.match(tt.item); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewSnapFilterErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(r *apiRequest)
+	}{
+		{"negative size", func(r *apiRequest) { r.Values.Size = -1 }},
+		{"bad date_from", func(r *apiRequest) { r.Values.DateFrom = "15.03.2024" }},
+		{"bad date_to", func(r *apiRequest) { r.Values.DateTo = "2024-3-15" }},
+	}
+	for _, tt := range tests {
+		var request apiRequest
+		tt.prepare(&request)
+		if _, err := newSnapFilter(&request); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestParseNativeCursor(t *testing.T) {
+	tests := []struct {
+		cursor string
+		after  string
+		skip   int
+		err    bool
+	}{
+		{"", "", 0, false},
+		{"c25hcC0x", "c25hcC0x", 0, false},
+		{"c25hcC0x~3", "c25hcC0x", 3, false},
+		{"~2", "", 2, false},
+		{"a~b~4", "a~b", 4, false},
+		{"c25hcC0x~x", "", 0, true},
+		{"c25hcC0x~-1", "", 0, true},
+	}
+	for _, tt := range tests {
+		after, skip, err := parseNativeCursor(tt.cursor)
+		if (err != nil) != tt.err || after != tt.after || skip != tt.skip {
+			t.Errorf("parseNativeCursor(%q) = %q, %d, %v", tt.cursor, after, skip, err)
+		}
+	}
+}
@@ -16,11 +16,16 @@ package router
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
-func createTLSConfig(pemFile, pemCertFile, pemPrivateKeyFile string, insecureSkipVerify bool) *tls.Config {
+func createTLSConfig(pemFile, pemCertFile, pemPrivateKeyFile string, insecureSkipVerify bool) (*tls.Config, error) {
 	tlsConfig := tls.Config{}
 	if insecureSkipVerify {
 		// pem settings are irrelevant if we're skipping verification anyway
@@ -29,21 +34,19 @@ func createTLSConfig(pemFile, pemCertFile, pemPrivateKeyFile string, insecureSki
 	if len(pemFile) > 0 {
 		rootCerts, err := loadCertificatesFrom(pemFile)
 		if err != nil {
-			log.Fatalf("Couldn't load root certificate from %s. Got %s.", pemFile, err)
-			return nil
+			return nil, fmt.Errorf("couldn't load root certificate from %s: %s", pemFile, err)
 		}
 		tlsConfig.RootCAs = rootCerts
 	}
 	if len(pemCertFile) > 0 && len(pemPrivateKeyFile) > 0 {
 		certs, err := tls.LoadX509KeyPair(pemCertFile, pemPrivateKeyFile)
 		if err != nil {
-			log.Fatalf("Couldn't setup client authentication. Got %s.", err)
-			return nil
+			return nil, fmt.Errorf("couldn't setup client authentication: %s", err)
 		}
 		tlsConfig.Certificates = []tls.Certificate{certs}
 	}
 
-	return &tlsConfig
+	return &tlsConfig, nil
 }
 
 func loadCertificatesFrom(pemFile string) (*x509.CertPool, error) {
@@ -52,7 +55,9 @@ func loadCertificatesFrom(pemFile string) (*x509.CertPool, error) {
 		return nil, err
 	}
 	certificates := x509.NewCertPool()
-	certificates.AppendCertsFromPEM(caCert)
+	if !certificates.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", pemFile)
+	}
 	return certificates, nil
 }
 
@@ -63,3 +68,115 @@ func loadPrivateKeyFrom(pemCertFile, pemPrivateKeyFile string) (*tls.Certificate
 	}
 	return &privateKey, nil
 }
+
+// certReloader serves the server certificate and re-reads it when the files change on disk
+type certReloader struct {
+	sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) lastModified() (time.Time, error) {
+	var t time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return t, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (cr *certReloader) load() error {
+	mt, err := cr.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modTime = mt
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.Lock()
+	defer cr.Unlock()
+	if time.Since(cr.checkedAt) > 10*time.Second {
+		cr.checkedAt = time.Now()
+		if mt, err := cr.lastModified(); err == nil && mt.After(cr.modTime) {
+			if err := cr.load(); err != nil {
+				log.Printf("Couldn't reload server certificate, keep the old one. Got %s.", err)
+			} else {
+				log.Println("Server certificate reloaded from", cr.certFile)
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func createServerTLSConfig(certFile, keyFile, minVersion, clientCA, clientAuth string) (*tls.Config, error) {
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load server certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{GetCertificate: cr.GetCertificate, MinVersion: tls.VersionTLS12}
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", minVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+	if len(clientCA) > 0 {
+		pool, err := loadCertificatesFrom(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load client CA from %s: %w", clientCA, err)
+		}
+		tlsConfig.ClientCAs = pool
+		switch clientAuth {
+		case "", "require":
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown client_auth mode %q", clientAuth)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// clientCertUser returns the subject of the verified client certificate, if any
+func clientCertUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName
+	}
+	return subject.String()
+}
@@ -0,0 +1,297 @@
+package router
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a generated certificate with its PEM files
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	tls      tls.Certificate
+	certFile string
+	keyFile  string
+}
+
+// newTestCert issues a certificate signed by ca, or a self-signed CA when ca is nil
+func newTestCert(t *testing.T, dir, name string, serial int64, ca *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	if c.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	if c.tls, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// startTLSServer serves clientCertUser of every request over the server TLS config
+func startTLSServer(t *testing.T, conf *tls.Config) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, clientCertUser(r))
+	}))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.Listener = tls.NewListener(srv.Listener, conf)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return strings.Replace(srv.URL, "http://", "https://", 1)
+}
+
+func TestServerTLSClientAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	server := newTestCert(t, dir, "server", 2, ca)
+	client := newTestCert(t, dir, "alice", 3, ca)
+	// сертификат, выпущенный другим CA, не принимается
+	otherCA := newTestCert(t, dir, "other-ca", 4, nil)
+	stranger := newTestCert(t, dir, "mallory", 5, otherCA)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name     string
+		clientCA string
+		mode     string
+		cert     *testCert
+		want     string // имя пользователя, пусто - без сертификата
+		fail     bool
+	}{
+		{"require with cert", ca.certFile, "require", client, "alice", false},
+		{"require by default", ca.certFile, "", client, "alice", false},
+		{"require without cert", ca.certFile, "require", nil, "", true},
+		{"require with unknown cert", ca.certFile, "require", stranger, "", true},
+		{"optional with cert", ca.certFile, "optional", client, "alice", false},
+		{"optional without cert", ca.certFile, "optional", nil, "", false},
+		{"optional with unknown cert", ca.certFile, "optional", stranger, "", true},
+		{"no client CA", "", "", client, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := createServerTLSConfig(server.certFile, server.keyFile, "", tt.clientCA, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			url := startTLSServer(t, conf)
+			cc := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+			if tt.cert != nil {
+				// сертификат отправляется, даже если сервер просит другой CA
+				cc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &tt.cert.tls, nil }
+			}
+			hc := &http.Client{Transport: &http.Transport{TLSClientConfig: cc}}
+			resp, err := hc.Get(url)
+			if tt.fail {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request succeeded, want a handshake error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			if string(b) != tt.want {
+				t.Errorf("user %q, want %q", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerTLSMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	server := newTestCert(t, dir, "server", 2, ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		min    string
+		client uint16 // максимальная версия клиента
+		fail   bool
+	}{
+		{"", tls.VersionTLS12, false},
+		{"", tls.VersionTLS11, true},
+		{"1.3", tls.VersionTLS12, true},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.1", tls.VersionTLS12, false},
+	}
+	for _, tt := range tests {
+		conf, err := createServerTLSConfig(server.certFile, server.keyFile, tt.min, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		url := startTLSServer(t, conf)
+		hc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost", MinVersion: tls.VersionTLS10, MaxVersion: tt.client}}}
+		resp, err := hc.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err != nil) != tt.fail {
+			t.Errorf("min_version %q, client up to %x: error %v, want failure %v", tt.min, tt.client, err, tt.fail)
+		}
+	}
+}
+
+func TestCreateServerTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	server := newTestCert(t, dir, "server", 2, ca)
+	tests := []struct {
+		name     string
+		cert     string
+		min      string
+		clientCA string
+		mode     string
+		err      string
+	}{
+		{"missing cert", filepath.Join(dir, "none.crt"), "", "", "", "couldn't load server certificate"},
+		{"unknown version", server.certFile, "1.4", "", "", `unknown TLS version "1.4"`},
+		{"bad client CA", server.certFile, "", server.keyFile, "", "couldn't load client CA"},
+		{"unknown mode", server.certFile, "", ca.certFile, "always", `unknown client_auth mode "always"`},
+	}
+	for _, tt := range tests {
+		_, err := createServerTLSConfig(tt.cert, server.keyFile, tt.min, tt.clientCA, tt.mode)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", 1, nil)
+	server := newTestCert(t, dir, "server", 2, ca)
+	cr, err := newCertReloader(server.certFile, server.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		c, _ := cr.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	// новые файлы с более поздним временем изменения
+	swap := func(c *testCert, age time.Duration) {
+		for _, f := range [][2]string{{c.certFile, server.certFile}, {c.keyFile, server.keyFile}} {
+			b, err := os.ReadFile(f[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(f[1], b, 0600); err != nil {
+				t.Fatal(err)
+			}
+			mt := time.Now().Add(age)
+			if err := os.Chtimes(f[1], mt, mt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if got := serial(); got != 2 {
+		t.Fatalf("serial %d, want 2", got)
+	}
+	swap(newTestCert(t, t.TempDir(), "server", 3, ca), time.Minute)
+	// файлы проверяются не чаще раза в 10 секунд
+	if got := serial(); got != 2 {
+		t.Errorf("reloaded within the check interval, serial %d", got)
+	}
+	cr.checkedAt = time.Time{}
+	if got := serial(); got != 3 {
+		t.Errorf("serial %d after the swap, want 3", got)
+	}
+
+	// битый ключ не заменяет рабочий сертификат
+	if err := os.WriteFile(server.keyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mt := time.Now().Add(2 * time.Minute)
+	os.Chtimes(server.keyFile, mt, mt)
+	cr.checkedAt = time.Time{}
+	if got := serial(); got != 3 {
+		t.Errorf("serial %d after a broken swap, want 3", got)
+	}
+}
+
+func TestClientCertUser(t *testing.T) {
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  string
+	}{
+		{"plain http", nil, ""},
+		{"no client cert", &tls.ConnectionState{}, ""},
+		{"common name", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}}}, "alice"},
+		{"no common name", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{Organization: []string{"ops"}}}}}}, "O=ops"},
+		// непроверенный сертификат не дает имени
+		{"unverified", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "mallory"}}}}, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = tt.state
+		if got := clientCertUser(r); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
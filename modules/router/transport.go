@@ -0,0 +1,408 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/config"
+	"github.com/flant/elasticsearch-extractor/modules/metrics"
+)
+
+type esNode struct {
+	url       string
+	dead      bool
+	deadUntil time.Time
+	failures  int
+}
+
+// nodePool spreads requests over the cluster nodes round-robin and keeps
+// nodes that refused connections out of rotation for a growing backoff period
+type nodePool struct {
+	sync.Mutex
+	cluster     string
+	nodes       []*esNode
+	seeds       []*esNode
+	next        int
+	deadTimeout time.Duration
+	onRecover   func()
+}
+
+func newNodePool(cluster string, urls []string, deadTimeout time.Duration) *nodePool {
+	p := &nodePool{cluster: cluster, deadTimeout: deadTimeout}
+	p.setNodes(urls)
+	p.seeds = p.nodes
+	return p
+}
+
+// setNodes replaces the node list keeping the state of nodes that are already known;
+// the configured hosts stay in the pool as seeds
+func (p *nodePool) setNodes(urls []string) {
+	p.Lock()
+	defer p.Unlock()
+	known := make(map[string]*esNode)
+	for _, n := range append(p.seeds, p.nodes...) {
+		known[n.url] = n
+	}
+	var nodes []*esNode
+	for _, u := range urls {
+		if n, ok := known[u]; ok {
+			nodes = append(nodes, n)
+		} else {
+			nodes = append(nodes, &esNode{url: u})
+		}
+	}
+	p.nodes = nodes
+}
+
+// all returns the nodes followed by the seeds that are not among them
+func (p *nodePool) all() []*esNode {
+	l := slices.Clone(p.nodes)
+	for _, s := range p.seeds {
+		if !slices.Contains(l, s) {
+			l = append(l, s)
+		}
+	}
+	return l
+}
+
+func (p *nodePool) size() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.all())
+}
+
+func (p *nodePool) urls() []string {
+	p.Lock()
+	defer p.Unlock()
+	var l []string
+	for _, n := range p.nodes {
+		l = append(l, n.url)
+	}
+	return l
+}
+
+func (p *nodePool) pick() *esNode {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	for i := 0; i < len(p.nodes); i++ {
+		n := p.nodes[p.next%len(p.nodes)]
+		p.next++
+		if !n.dead || now.After(n.deadUntil) {
+			return n
+		}
+	}
+	// все найденные узлы недоступны - идем через seeds из конфига, в том числе за новым списком узлов
+	all := p.all()
+	for _, n := range all[len(p.nodes):] {
+		if !n.dead || now.After(n.deadUntil) {
+			return n
+		}
+	}
+	// недоступны и они - пробуем тот, у которого раньше всех закончится backoff
+	var best *esNode
+	for _, n := range all {
+		if best == nil || n.deadUntil.Before(best.deadUntil) {
+			best = n
+		}
+	}
+	return best
+}
+
+func (p *nodePool) markDead(n *esNode, err error) {
+	p.Lock()
+	defer p.Unlock()
+	n.failures++
+	shift := n.failures - 1
+	if shift > 5 {
+		shift = 5
+	}
+	n.dead = true
+	n.deadUntil = time.Now().Add(p.deadTimeout * time.Duration(1<<shift))
+	log.Printf("Cluster %s: node %s marked dead until %s: %s\n", p.cluster, n.url, n.deadUntil.Format(time.RFC3339), err)
+}
+
+func (p *nodePool) markAlive(n *esNode) {
+	p.Lock()
+	recovered := n.dead
+	n.dead = false
+	n.failures = 0
+	onRecover := p.onRecover
+	p.Unlock()
+	if recovered {
+		log.Printf("Cluster %s: node %s is alive again\n", p.cluster, n.url)
+		if onRecover != nil {
+			onRecover()
+		}
+	}
+}
+
+// setOnRecover sets the function called when a dead node answers again
+func (p *nodePool) setOnRecover(f func()) {
+	p.Lock()
+	defer p.Unlock()
+	p.onRecover = f
+}
+
+// isConnError reports errors that happened before the request reached the node,
+// so it is safe to send the same request to another one
+func isConnError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+func (c *esCluster) newRequest(method, u string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	actionRequest, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	actionRequest.Header.Set("Content-Type", "application/json")
+	actionRequest.Header.Set("Connection", "keep-alive")
+	if c.signer != nil {
+		if err := c.signer.Sign(actionRequest, body, time.Now()); err != nil {
+			return nil, err
+		}
+	} else if auth := c.authHeader(); auth != "" {
+		actionRequest.Header.Set("Authorization", auth)
+	} else if c.conf.Username != "" {
+		actionRequest.SetBasicAuth(c.conf.Username, c.conf.Password)
+	}
+	return actionRequest, nil
+}
+
+// authHeader builds the token Authorization header; api_key takes precedence over
+// service_token and bearer_token, basic auth is used only when none of them is set
+func (c *esCluster) authHeader() string {
+	switch {
+	case c.conf.ApiKey != "":
+		key := c.conf.ApiKey
+		// id:key переводим в base64, уже закодированный ключ передаем как есть
+		if strings.Contains(key, ":") {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		return "ApiKey " + key
+	case c.conf.ServiceToken != "":
+		return "Bearer " + c.conf.ServiceToken
+	case c.conf.BearerToken != "":
+		return "Bearer " + c.conf.BearerToken
+	}
+	return ""
+}
+
+// isIdempotent reports requests that can be repeated without side effects: reads, deletes
+// and searches including scroll continuations
+func isIdempotent(method, path string) bool {
+	switch method {
+	case "GET", "HEAD", "DELETE":
+		return true
+	case "POST":
+		p := path
+		if i := strings.Index(p, "?"); i >= 0 {
+			p = p[:i]
+		}
+		switch endpointLabel(p) {
+		case "_search", "_search/scroll", "_count", "_msearch", "_field_caps", "_mapping":
+			return true
+		}
+	}
+	return false
+}
+
+func retryBackoff(r config.Retry, attempt int) time.Duration {
+	shift := attempt - 1
+	if shift > 10 {
+		shift = 10
+	}
+	d := time.Duration(r.Backoff) * time.Millisecond << shift
+	if max := time.Duration(r.MaxBackoff) * time.Millisecond; d > max {
+		d = max
+	}
+	// full jitter, чтобы клиенты не повторяли запросы синхронно
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// perform is the single transport behind doGet, doPost and doDel: it sends the request
+// to the next live node of the cluster, fails over to other nodes on connection errors
+// and repeats idempotent requests on transient errors according to the cluster retry policy
+func (rt *Router) perform(method, path string, body []byte, cluster string) (*http.Response, error) {
+	return rt.performCtx(context.Background(), method, path, body, cluster)
+}
+
+// performCtx is perform with a context that cancels the request and the retries, e.g. when
+// the server stops while an export is waiting for a scroll batch
+func (rt *Router) performCtx(ctx context.Context, method, path string, body []byte, cluster string) (*http.Response, error) {
+	c, err := rt.cl.get(cluster, "")
+	if err != nil {
+		return nil, err
+	}
+
+	r := c.conf.Retry
+	idempotent := isIdempotent(method, path)
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.performOnce(ctx, c, method, path, body)
+
+		var reason string
+		if err != nil {
+			reason = "error"
+		} else if slices.Contains(r.Statuses, resp.StatusCode) {
+			reason = strconv.Itoa(resp.StatusCode)
+		}
+		if reason == "" || !idempotent || attempt >= r.MaxAttempts || rt.stopping() {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			err = errors.New(resp.Status)
+		}
+		wait := retryBackoff(r, attempt)
+		endpoint := endpointLabel(strings.SplitN(path, "?", 2)[0])
+		metrics.ESRetries.WithLabelValues(c.conf.Name, endpoint, reason).Inc()
+		log.Printf("Cluster %s: %s %s failed (%s), retry %d/%d in %s\n", c.conf.Name, method, endpoint, err, attempt, r.MaxAttempts-1, wait)
+
+		select {
+		case <-rt.ctx.Done():
+			return nil, err
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// cancelBody releases the request deadline once the caller is done with the response
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (rt *Router) performOnce(parent context.Context, c *esCluster, method, path string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for i := 0; i < c.pool.size(); i++ {
+		node := c.pool.pick()
+		req, err := c.newRequest(method, node.url+path, body)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(parent, c.timeout(path))
+		req = req.WithContext(ctx)
+
+		start := time.Now()
+		resp, err := c.httpClient(path).Do(req)
+		status := "error"
+		if err == nil {
+			status = strconv.Itoa(resp.StatusCode)
+		}
+		metrics.ESRequestDuration.WithLabelValues(c.conf.Name, endpointLabel(req.URL.Path), req.Method, status).Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			cancel()
+			// отмененный запрос - не повод считать узел недоступным
+			if parent.Err() != nil {
+				return nil, parent.Err()
+			}
+			if !isConnError(err) {
+				return nil, err
+			}
+			c.pool.markDead(node, err)
+			lastErr = err
+			continue
+		}
+		c.pool.markAlive(node)
+		resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+type nodesHttp struct {
+	Nodes map[string]struct {
+		Http struct {
+			PublishAddress string `json:"publish_address"`
+		} `json:"http"`
+	} `json:"nodes"`
+}
+
+// sniff discovers the HTTP addresses of all cluster nodes via _nodes/http
+func (rt *Router) sniff(c *esCluster) error {
+	response, err := rt.doGet("_nodes/http?format=json", c.conf.Name)
+	if err != nil {
+		return err
+	}
+	var nh nodesHttp
+	err = json.Unmarshal(response, &nh)
+	if err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if u, err := url.Parse(c.conf.Hosts[0]); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+	var urls []string
+	for _, n := range nh.Nodes {
+		addr := n.Http.PublishAddress
+		if addr == "" {
+			continue
+		}
+		// publish_address может быть в виде hostname/ip:port
+		if i := strings.LastIndex(addr, "/"); i >= 0 {
+			addr = addr[i+1:]
+		}
+		urls = append(urls, scheme+"://"+addr+"/")
+	}
+	if len(urls) == 0 {
+		return errors.New("no nodes with http publish address")
+	}
+	sort.Strings(urls)
+	c.pool.setNodes(urls)
+	return nil
+}
+
+func (rt *Router) sniffLoop(c *esCluster) {
+	interval := time.Duration(c.conf.SniffInterval) * time.Second
+	for {
+		if err := rt.sniff(c); err != nil {
+			log.Printf("Cluster %s: sniffing failed: %s\n", c.conf.Name, err)
+		} else {
+			log.Printf("Cluster %s: nodes %v\n", c.conf.Name, c.pool.urls())
+		}
+		select {
+		case <-rt.ctx.Done():
+			return
+		case <-c.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package router
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/flant/elasticsearch-extractor/modules/config"
+)
+
+func TestIsIdempotent(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   bool
+	}{
+		{"GET", "_cat/indices?format=json", true},
+		{"HEAD", "logs-2024.01.01", true},
+		{"DELETE", "_search/scroll/abc", true},
+		{"POST", "logs-*/_search?scroll=1m", true},
+		{"POST", "_search/scroll", true},
+		{"POST", "logs-*/_count", true},
+		{"POST", "_msearch", true},
+		{"POST", "logs/_field_caps?fields=*", true},
+		{"POST", "_snapshot/s3/snap-1/_restore?wait_for_completion=false", false},
+		{"POST", "logs/_doc", false},
+		{"POST", "logs", false},
+		{"PUT", "logs/_settings", false},
+		// имя индекса похоже на эндпоинт, но это путь запроса
+		{"POST", "my_search/_doc?x=_search", false},
+	}
+	for _, tt := range tests {
+		if got := isIdempotent(tt.method, tt.path); got != tt.want {
+			t.Errorf("isIdempotent(%s, %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	r := config.Retry{Backoff: 100, MaxBackoff: 1000}
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{40, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			if d := retryBackoff(r, tt.attempt); d < 0 || d > tt.max {
+				t.Fatalf("attempt %d: backoff %s outside [0, %s]", tt.attempt, d, tt.max)
+			}
+		}
+	}
+	if d := retryBackoff(config.Retry{}, 1); d != 0 {
+		t.Errorf("zero backoff gave %s", d)
+	}
+}
+
+func TestNodePoolSeeds(t *testing.T) {
+	p := newNodePool("test", []string{"http://lb:9200/"}, time.Minute)
+	p.setNodes([]string{"http://10.0.0.1:9200/", "http://10.0.0.2:9200/"})
+
+	if got := p.size(); got != 3 {
+		t.Fatalf("size %d, want 3", got)
+	}
+	for i := 0; i < 4; i++ {
+		if n := p.pick(); n.url == "http://lb:9200/" {
+			t.Fatalf("seed picked while sniffed nodes are alive")
+		}
+	}
+
+	for _, n := range p.nodes {
+		p.markDead(n, errors.New("refused"))
+	}
+	if n := p.pick(); n.url != "http://lb:9200/" {
+		t.Fatalf("picked %s, want the seed", n.url)
+	}
+
+	// seed попал в список узлов, 10.0.0.1 остается мертвым
+	p.setNodes([]string{"http://10.0.0.1:9200/", "http://lb:9200/"})
+	if got := p.size(); got != 2 {
+		t.Fatalf("size %d, want 2", got)
+	}
+	if n := p.pick(); n.url != "http://lb:9200/" {
+		t.Fatalf("picked %s, want the seed", n.url)
+	}
+
+	p.markDead(p.seeds[0], errors.New("refused"))
+	if n := p.pick(); n == nil {
+		t.Fatal("no node picked when all are dead")
+	}
+}
+
+func TestExportClient(t *testing.T) {
+	c, err := newCluster(config.Cluster{Name: "test", Hosts: []string{"http://es1:9200/"},
+		Transport: config.Transport{ResponseHeaderTimeout: 30, RequestTimeout: 30, ExportTimeout: 600}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path    string
+		header  time.Duration
+		timeout time.Duration
+	}{
+		{"logs-*/_search", 30 * time.Second, 30 * time.Second},
+		{"logs-*/_search?scroll=1m", 0, 600 * time.Second},
+		{"_search/scroll", 0, 600 * time.Second},
+	}
+	for _, tt := range tests {
+		tr := c.httpClient(tt.path).Transport.(*http.Transport)
+		if tr.ResponseHeaderTimeout != tt.header || c.timeout(tt.path) != tt.timeout {
+			t.Errorf("%s: response header timeout %s, timeout %s", tt.path, tr.ResponseHeaderTimeout, c.timeout(tt.path))
+		}
+	}
+}
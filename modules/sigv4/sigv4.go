@@ -0,0 +1,258 @@
+package sigv4
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	algorithm  = "AWS4-HMAC-SHA256"
+	timeFormat = "20060102T150405Z"
+	dateFormat = "20060102"
+)
+
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+type Signer struct {
+	Region      string
+	Service     string
+	Credentials Credentials
+	// Load re-reads the credentials every Interval, so keys rotated in the environment
+	// source (e.g. a refreshed shared credentials file) are picked up; nil for static keys
+	Load     func() (Credentials, error)
+	Interval time.Duration
+
+	mu     sync.Mutex
+	loaded time.Time
+}
+
+// credentials returns the current credentials, reloading them when they are due;
+// a failed reload keeps the previous ones
+func (s *Signer) credentials(now time.Time) Credentials {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Load != nil && now.Sub(s.loaded) >= s.Interval {
+		s.loaded = now
+		c, err := s.Load()
+		if err != nil {
+			log.Println("sigv4: cannot reload credentials, keeping the previous ones:", err)
+		} else {
+			s.Credentials = c
+		}
+	}
+	return s.Credentials
+}
+
+// LoadCredentials resolves credentials the same way the AWS SDKs do for the static
+// part of the chain: AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN first,
+// then the profile (AWS_PROFILE or default) of the shared credentials file.
+func LoadCredentials(profile string) (Credentials, error) {
+	c := Credentials{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.AccessKey != "" && c.SecretKey != "" {
+		return c, nil
+	}
+
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	file := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return c, err
+		}
+		file = filepath.Join(home, ".aws", "credentials")
+	}
+	return readCredentialsFile(file, profile)
+}
+
+func readCredentialsFile(file, profile string) (Credentials, error) {
+	var c Credentials
+	f, err := os.Open(file)
+	if err != nil {
+		return c, fmt.Errorf("no AWS credentials in environment and %s", err)
+	}
+	defer f.Close()
+
+	var section string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			c.AccessKey = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			c.SecretKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			c.SessionToken = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return c, err
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return c, fmt.Errorf("profile %s not found in %s", profile, file)
+	}
+	return c, nil
+}
+
+// Sign adds the X-Amz-* and Authorization headers to req; body must be the exact payload
+func (s *Signer) Sign(req *http.Request, body []byte, now time.Time) error {
+	creds := s.credentials(now)
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return errors.New("sigv4: empty credentials")
+	}
+	now = now.UTC()
+	amzDate := now.Format(timeFormat)
+	payloadHash := hashHex(body)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{
+		"host":                 host,
+		"x-amz-date":           amzDate,
+		"x-amz-content-sha256": payloadHash,
+	}
+	if creds.SessionToken != "" {
+		headers["x-amz-security-token"] = creds.SessionToken
+	}
+	req.Header.Set("Authorization", s.authorization(req, headers, payloadHash, now, creds))
+	return nil
+}
+
+// authorization builds the Authorization header value for the signed headers
+func (s *Signer) authorization(req *http.Request, headers map[string]string, payloadHash string, now time.Time, creds Credentials) string {
+	amzDate := now.Format(timeFormat)
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL.EscapedPath()),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{now.Format(dateFormat), s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+
+	key := signingKey(creds.SecretKey, now.Format(dateFormat), s.Region, s.Service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	return fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, creds.AccessKey, scope, signedHeaders, signature)
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// canonicalPath encodes the already escaped path once more, as required for every service but S3
+func canonicalPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return escape(p, false)
+}
+
+func canonicalQuery(req *http.Request) string {
+	q := req.URL.Query()
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, escape(k, true)+"="+escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// escape is RFC 3986 encoding: only unreserved characters are left as is
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}